@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/JustMangler/peerchat/src"
@@ -13,22 +16,197 @@ func init() {
 	logrus.SetOutput(os.Stdout)
 }
 
+// stringList is a flag value that may be repeated or comma separated
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*s = append(*s, item)
+		}
+	}
+	return nil
+}
+
 func main() {
 
 	// Parse command flags to get username
 	username := flag.String("username", "guest", "Username to join the chatroom with")
+	identity := flag.String("identity", src.DefaultIdentityPath(), "Path of the identity file holding the node's private key")
+	keytype := flag.String("keytype", src.KeyTypeEd25519, "Key type used when creating a new identity (ed25519 or rsa)")
+	discovery := flag.String("discovery", src.DiscoveryDHT, "Peer discovery method (dht, mdns or both)")
+	configpath := flag.String("config", "", "Path of a JSON config file")
+	var bootstrap stringList
+	flag.Var(&bootstrap, "bootstrap", "Bootstrap peer multiaddr (may be repeated or comma separated)")
+	publicbootstrap := flag.Bool("public-bootstrap", true, "Also bootstrap from the public IPFS bootstrap peers")
+	swarmkey := flag.String("swarmkey", "", "Path of a swarm.key file to join a private network")
+	mode := flag.String("mode", "chat", "Run mode: chat starts the chat UI, bootstrap runs a headless bootstrap/relay node")
+	port := flag.Int("port", 0, "TCP and QUIC port to listen on (0 picks a random port)")
+	var listen stringList
+	flag.Var(&listen, "listen", "Listen multiaddr, overrides -port and the transport flags (may be repeated or comma separated)")
+	ipv6 := flag.Bool("ipv6", false, "Also listen on IPv6")
+	quic := flag.Bool("quic", false, "Enable the QUIC transport")
+	websocket := flag.Bool("ws", false, "Enable the WebSocket transport")
+	websocketport := flag.Int("ws-port", 0, "TCP port for WebSocket connections (0 picks a random port)")
+	var security stringList
+	flag.Var(&security, "security", "Security protocols in order of preference: tls, noise (comma separated)")
+	datadir := flag.String("datadir", src.DefaultDataDir(), "Directory for message history and other local state")
+	historyreplay := flag.Int("history", 50, "Number of stored messages shown when joining a room")
+	historymaxage := flag.Duration("history-max-age", 0, "Drop stored messages older than this, e.g. 720h (0 keeps all)")
+	historymaxsize := flag.Int64("history-max-size", 0, "Maximum size of a room's history file in bytes (0 is unlimited)")
+	downloaddir := flag.String("download-dir", src.DefaultDownloadDir(), "Directory accepted files are saved to")
+	maxfilesize := flag.Int64("max-file-size", src.DefaultMaxFileSize, "Largest offered file accepted in bytes, larger offers are ignored (0 is unlimited)")
+	autoopen := flag.Bool("auto-open", false, "Open accepted files with the default application once downloaded")
+	room := flag.String("room", "lobby", "Chat room to join on startup")
+	roompassphrase := flag.String("room-passphrase", "", "Passphrase of the startup room, makes it an end-to-end encrypted private room")
+	join := flag.String("join", "", "Invite token of a room to join on startup, overrides -room")
+	var rooms stringList
+	flag.Var(&rooms, "rooms", "Chat rooms relayed in bootstrap mode (may be repeated or comma separated)")
 	flag.Parse()
 
+	if *mode != "chat" && *mode != "bootstrap" {
+		logrus.Fatalf("Unknown run mode '%s'", *mode)
+	}
+
+	// Read the config file, command line flags take precedence over it
+	config := src.DefaultConfig()
+	if *configpath != "" {
+		var err error
+		if config, err = src.LoadConfig(*configpath); err != nil {
+			logrus.WithError(err).Fatal("Failed to load config")
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "bootstrap":
+			config.Bootstrap = bootstrap
+		case "public-bootstrap":
+			config.PublicBootstrap = *publicbootstrap
+		case "swarmkey":
+			config.SwarmKey = *swarmkey
+		case "listen":
+			config.ListenAddrs = listen
+		case "port":
+			config.Port = *port
+		case "ipv6":
+			config.IPv6 = *ipv6
+		case "quic":
+			config.QUIC = *quic
+		case "ws":
+			config.WebSocket = *websocket
+		case "ws-port":
+			config.WebSocketPort = *websocketport
+		case "security":
+			config.Security = security
+		}
+	})
+
+	// Load the node identity, creating it on first run
+	privateKey, err := src.LoadIdentity(*identity, *keytype, os.Getenv("PEERCHAT_PASSPHRASE"))
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to load node identity")
+	}
+
+	// Load the private network key, public peers can never join a private network
+	var psk []byte
+	if config.SwarmKey != "" {
+		if psk, err = src.LoadSwarmKey(config.SwarmKey); err != nil {
+			logrus.WithError(err).Fatal("Failed to load swarm key")
+		}
+		config.PublicBootstrap = false
+	}
+
+	bootstrapPeers, err := src.ResolveBootstrapPeers(config.Bootstrap, config.PublicBootstrap)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to parse bootstrap peers")
+	}
+
+	// Open the local message history
+	history, err := src.OpenHistoryStore(filepath.Join(*datadir, "history"), src.HistoryOptions{
+		Replay:  *historyreplay,
+		MaxAge:  *historymaxage,
+		MaxSize: *historymaxsize,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to open message history")
+	}
+	directhistory, err := src.OpenHistoryStore(filepath.Join(*datadir, "dm"), src.HistoryOptions{})
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to open direct message history")
+	}
+
+	// Open the store of shared file blocks
+	blocks, err := src.OpenBlockStore(filepath.Join(*datadir, "blocks"))
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to open block store")
+	}
+
 	// Initialize a new Node
-	node := src.InitializeNode()
+	node, err := src.NewNode(context.Background(),
+		src.WithIdentity(privateKey),
+		src.WithDiscoveryMode(*discovery),
+		src.WithBootstrapPeers(bootstrapPeers),
+		src.WithSwarmKey(psk),
+		src.WithListenAddrs(config.ListenAddrs),
+		src.WithListenPort(config.Port),
+		src.WithIPv6(config.IPv6),
+		src.WithQUIC(config.QUIC),
+		src.WithWebSocket(config.WebSocket, config.WebSocketPort),
+		src.WithSecurity(config.Security...),
+		src.WithRelayHop(*mode == "bootstrap"),
+		src.WithHistory(history),
+		src.WithDirectHistory(directhistory),
+		src.WithBlockStore(blocks),
+		src.WithDownloads(src.DownloadOptions{
+			Dir:      *downloaddir,
+			MaxSize:  *maxfilesize,
+			AutoOpen: *autoopen,
+		}),
+	)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to set up P2P node")
+	}
 	logrus.Infoln("Completed P2P Setup")
 
+	// Run headless until the supervisor stops the process
+	if *mode == "bootstrap" {
+		if len(rooms) == 0 {
+			rooms = stringList{"lobby"}
+		}
+		src.RunBootstrap(node, rooms)
+		return
+	}
+
 	// Connect to peers using the specified discovery method
-	node.AnnounceServiceCID()
+	if err := node.DiscoverPeers(); err != nil {
+		logrus.WithError(err).Fatal("Failed to discover peers")
+	}
 	logrus.Infoln("Connected to Service Peers")
 
 	// Join the chat room
-	chatApp, _ := src.JoinRoom(node, *username, "lobby")
+	var chatApp *src.ChatRoom
+	if *join != "" {
+		var invite *src.Invite
+		if invite, err = src.ParseInvite(*join); err != nil {
+			logrus.WithError(err).Fatal("Failed to read invite")
+		}
+		chatApp, err = node.AcceptInvite(invite, *username)
+	} else if *roompassphrase != "" {
+		var key []byte
+		if key, err = src.DeriveRoomKey(*room, *roompassphrase); err != nil {
+			logrus.WithError(err).Fatal("Failed to derive room key")
+		}
+		chatApp, err = src.JoinPrivateRoom(node, *username, *room, key)
+	} else {
+		chatApp, err = src.JoinRoom(node, *username, *room)
+	}
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to join the chat room")
+	}
 	logrus.Infof("Joined the '%s' chatroom as '%s'", chatApp.RoomName, chatApp.Username)
 
 	// Wait for network setup to complete
@@ -36,5 +214,13 @@ func main() {
 
 	// Create and start the Chat UI
 	ui := src.NewUI(chatApp)
-	ui.Run()
-}
\ No newline at end of file
+	if err := ui.Run(); err != nil {
+		logrus.WithError(err).Error("Chat UI exited with an error")
+	}
+
+	// Release the room and node resources once the UI has stopped
+	ui.Rooms.LeaveAll()
+	if err := node.Close(); err != nil {
+		logrus.WithError(err).Error("Failed to close node")
+	}
+}
@@ -0,0 +1,608 @@
+package src
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/sirupsen/logrus"
+)
+
+// Protocol used to fetch content-addressed blocks from a peer holding them
+const blockProtocol = "/peerchat/block/1.0.0"
+
+const (
+	// Largest block accepted, a manifest may be larger than a chunk
+	maxBlockSize = 2 * fileChunkSize
+	// Most providers asked for the blocks of a shared file
+	maxBlockProviders = 8
+	// Deadline for finding the providers of a shared file
+	blockFindTimeout = time.Minute
+	// How often the shared files held locally are announced again, well
+	// within the lifetime of DHT provider records
+	blockReprovideInterval = 12 * time.Hour
+)
+
+// Blocks are raw SHA-256 CIDv1 blocks, like raw leaves in IPFS
+var blockPrefix = cid.Prefix{
+	Version:  1,
+	Codec:    cid.Raw,
+	MhType:   multihash.SHA2_256,
+	MhLength: -1,
+}
+
+// fileManifest lists the chunk blocks of a shared file in order. The CID
+// of the manifest block is the CID the file is shared under.
+type fileManifest struct {
+	Name      string   `json:"name"`
+	Size      int64    `json:"size"`
+	ChunkSize int64    `json:"chunk_size"`
+	Blocks    []string `json:"blocks"`
+}
+
+// blockRequest asks a peer for blocks of the shared file with CID Root.
+type blockRequest struct {
+	Root string   `json:"root"`
+	CIDs []string `json:"cids"`
+}
+
+// BlockStore keeps content-addressed blocks as files named by their CID
+// under a data directory. Shared files are recorded as roots once all of
+// their blocks are stored, along with the rooms they were shared in, and
+// only roots are announced in the DHT.
+type BlockStore struct {
+	dir string
+}
+
+// OpenBlockStore creates the block directory if needed and returns a
+// store writing into it.
+func OpenBlockStore(dir string) (*BlockStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "roots"), 0700); err != nil {
+		return nil, fmt.Errorf("unable to create block directory: %w", err)
+	}
+	return &BlockStore{dir: dir}, nil
+}
+
+// blockPath returns the file of a block.
+func (b *BlockStore) blockPath(c cid.Cid) string {
+	return filepath.Join(b.dir, c.String())
+}
+
+// Put stores a block and returns its CID.
+func (b *BlockStore) Put(data []byte) (cid.Cid, error) {
+	c, err := blockPrefix.Sum(data)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if b.Has(c) {
+		return c, nil
+	}
+
+	// Write to a temporary file first so a block is never stored partially
+	file, err := ioutil.TempFile(b.dir, ".block-*")
+	if err != nil {
+		return cid.Undef, fmt.Errorf("unable to store block: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return cid.Undef, fmt.Errorf("unable to store block: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return cid.Undef, err
+	}
+	if err := os.Rename(file.Name(), b.blockPath(c)); err != nil {
+		return cid.Undef, fmt.Errorf("unable to store block: %w", err)
+	}
+	return c, nil
+}
+
+// Get returns a stored block after checking it against its CID.
+func (b *BlockStore) Get(c cid.Cid) ([]byte, error) {
+	data, err := ioutil.ReadFile(b.blockPath(c))
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyBlock(c, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Has reports whether a block is stored.
+func (b *BlockStore) Has(c cid.Cid) bool {
+	_, err := os.Stat(b.blockPath(c))
+	return err == nil
+}
+
+// Size returns the size of a stored block, 0 if it is not stored.
+func (b *BlockStore) Size(c cid.Cid) int64 {
+	info, err := os.Stat(b.blockPath(c))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// rootPath returns the file recording a shared file and its rooms.
+func (b *BlockStore) rootPath(c cid.Cid) string {
+	return filepath.Join(b.dir, "roots", c.String())
+}
+
+// AddRoot records a shared file whose blocks are all stored, and the room
+// it is shared in.
+func (b *BlockStore) AddRoot(c cid.Cid, room string) error {
+	rooms := b.RootRooms(c)
+	for _, known := range rooms {
+		if known == room {
+			return nil
+		}
+	}
+
+	data, err := json.Marshal(append(rooms, room))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(b.rootPath(c), data, 0600)
+}
+
+// RootRooms returns the rooms a shared file is served to.
+func (b *BlockStore) RootRooms(c cid.Cid) []string {
+	data, err := ioutil.ReadFile(b.rootPath(c))
+	if err != nil {
+		return nil
+	}
+
+	// Files recorded without their rooms are not served to anyone
+	var rooms []string
+	if err := json.Unmarshal(data, &rooms); err != nil {
+		return nil
+	}
+	return rooms
+}
+
+// Roots returns the shared files held in the store.
+func (b *BlockStore) Roots() ([]cid.Cid, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(b.dir, "roots"))
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []cid.Cid
+	for _, entry := range entries {
+		if c, err := cid.Decode(entry.Name()); err == nil {
+			roots = append(roots, c)
+		}
+	}
+	return roots, nil
+}
+
+// verifyBlock checks that a block's content matches its CID.
+func verifyBlock(c cid.Cid, data []byte) error {
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+	if !sum.Equals(c) {
+		return fmt.Errorf("block %s does not match its CID", c)
+	}
+	return nil
+}
+
+// ShareFile splits a local file into blocks, stores them and announces
+// the file in the DHT. It returns the CID the file can be fetched with.
+// The file is only served to members of the given room.
+func (n *Node) ShareFile(cr *ChatRoom, filePath string) (cid.Cid, fileManifest, error) {
+	if n.Blocks == nil {
+		return cid.Undef, fileManifest{}, errors.New("no block store configured")
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return cid.Undef, fileManifest{}, fmt.Errorf("unable to open file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return cid.Undef, fileManifest{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return cid.Undef, fileManifest{}, errors.New("not a regular file")
+	}
+
+	manifest := fileManifest{Name: filepath.Base(filePath), Size: info.Size(), ChunkSize: fileChunkSize}
+	buf := make([]byte, fileChunkSize)
+	for i := 0; int64(i) < chunkCount(info.Size()); i++ {
+		chunk := buf[:chunkLength(info.Size(), i)]
+		if _, err := io.ReadFull(file, chunk); err != nil {
+			return cid.Undef, fileManifest{}, fmt.Errorf("unable to read file: %w", err)
+		}
+		c, err := n.Blocks.Put(chunk)
+		if err != nil {
+			return cid.Undef, fileManifest{}, err
+		}
+		manifest.Blocks = append(manifest.Blocks, c.String())
+	}
+
+	root, err := n.storeManifest(manifest, cr.historyKey)
+	if err != nil {
+		return cid.Undef, fileManifest{}, err
+	}
+
+	go n.provideBlock(root)
+	return root, manifest, nil
+}
+
+// storeManifest stores the manifest of a file whose chunks are all stored
+// and records the file as a root shared in the given room.
+func (n *Node) storeManifest(manifest fileManifest, room string) (cid.Cid, error) {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if len(data) > maxBlockSize {
+		return cid.Undef, errors.New("file is too large to share")
+	}
+
+	root, err := n.Blocks.Put(data)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return root, n.Blocks.AddRoot(root, room)
+}
+
+// provideBlock announces in the DHT that this node holds a shared file.
+func (n *Node) provideBlock(c cid.Cid) {
+	if err := n.DHT.Provide(n.Context, c, true); err != nil && n.Context.Err() == nil {
+		logrus.WithError(err).Debugf("Failed to announce shared file %s", c)
+	}
+}
+
+// reprovideBlocks announces every shared file held locally, at startup
+// and then every blockReprovideInterval, so files stay fetchable after
+// restarts and after the DHT provider records expire.
+func (n *Node) reprovideBlocks() {
+	ticker := time.NewTicker(blockReprovideInterval)
+	defer ticker.Stop()
+
+	for {
+		roots, err := n.Blocks.Roots()
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to list shared files")
+		}
+		for _, root := range roots {
+			n.provideBlock(root)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-n.Context.Done():
+			return
+		}
+	}
+}
+
+// FetchFile retrieves a shared file by CID from the peers holding it and
+// returns the path it was saved to. Fetched blocks are kept in the block
+// store, so an interrupted fetch resumes where it stopped and this node
+// serves the file to the members of the given room once it is complete.
+func (n *Node) FetchFile(ctx context.Context, cr *ChatRoom, fileCID string) (string, error) {
+	if n.Blocks == nil {
+		return "", errors.New("no block store configured")
+	}
+	root, err := cid.Decode(fileCID)
+	if err != nil {
+		return "", fmt.Errorf("invalid CID: %w", err)
+	}
+
+	// Only look up providers once a block is missing locally
+	var providers []peer.ID
+	fetch := func(ctx context.Context, cids []cid.Cid, t *transfer) error {
+		if providers == nil && len(missingBlocks(n.Blocks, cids)) > 0 {
+			providers = n.findBlockProviders(ctx, root)
+		}
+		return n.fetchBlocks(ctx, root, cids, providers, t)
+	}
+
+	// Fetch and check the manifest before any file content
+	if err := fetch(ctx, []cid.Cid{root}, nil); err != nil {
+		return "", err
+	}
+	data, err := n.Blocks.Get(root)
+	if err != nil {
+		return "", err
+	}
+	var manifest fileManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return "", fmt.Errorf("%s is not a shared file", root)
+	}
+
+	chunks := make([]cid.Cid, len(manifest.Blocks))
+	for i, block := range manifest.Blocks {
+		if chunks[i], err = cid.Decode(block); err != nil {
+			return "", fmt.Errorf("malformed manifest: %w", err)
+		}
+	}
+	if manifest.ChunkSize != fileChunkSize || int64(len(chunks)) != chunkCount(manifest.Size) {
+		return "", errors.New("malformed manifest")
+	}
+	if !n.AcceptsFileSize(manifest.Size) {
+		return "", fmt.Errorf("%s exceeds the maximum accepted size of %s", formatSize(manifest.Size), formatSize(n.downloads.MaxSize))
+	}
+
+	path, err := n.trackDownload(ctx, manifest.Name, "", manifest.Size, func(ctx context.Context, t *transfer) (string, error) {
+		var present int64
+		for i, c := range chunks {
+			if n.Blocks.Has(c) {
+				present += chunkLength(manifest.Size, i)
+			}
+		}
+		t.resume(present)
+
+		if err := fetch(ctx, chunks, t); err != nil {
+			return "", err
+		}
+		if err := n.Blocks.AddRoot(root, cr.historyKey); err != nil {
+			logrus.WithError(err).Warn("Failed to record shared file")
+		}
+		go n.provideBlock(root)
+
+		return n.assembleFile(manifest, chunks)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	n.openDownload(path)
+	return path, nil
+}
+
+// findBlockProviders returns the peers announcing a shared file in the DHT.
+func (n *Node) findBlockProviders(ctx context.Context, c cid.Cid) []peer.ID {
+	findCtx, cancel := context.WithTimeout(ctx, blockFindTimeout)
+	defer cancel()
+
+	providers := []peer.ID{}
+	for info := range n.DHT.FindProvidersAsync(findCtx, c, maxBlockProviders) {
+		if info.ID == n.Host.ID() {
+			continue
+		}
+		if len(info.Addrs) > 0 {
+			n.Host.Peerstore().AddAddrs(info.ID, info.Addrs, time.Hour)
+		}
+		providers = append(providers, info.ID)
+	}
+	return providers
+}
+
+// fetchBlocks stores the given blocks, asking the providers in turn for
+// the blocks still missing.
+func (n *Node) fetchBlocks(ctx context.Context, root cid.Cid, cids []cid.Cid, providers []peer.ID, t *transfer) error {
+	missing := missingBlocks(n.Blocks, cids)
+	for _, p := range providers {
+		if len(missing) == 0 || ctx.Err() != nil {
+			break
+		}
+		if err := n.requestBlocks(ctx, p, root, missing, t); err != nil {
+			logrus.WithError(err).Debugf("Failed to fetch blocks from %s", p)
+		}
+		missing = missingBlocks(n.Blocks, missing)
+	}
+
+	if len(missing) > 0 {
+		if len(providers) == 0 {
+			return errors.New("no peer holds the file")
+		}
+		return fmt.Errorf("%d blocks could not be fetched", len(missing))
+	}
+	return nil
+}
+
+// missingBlocks returns the blocks that are not stored yet.
+func missingBlocks(store *BlockStore, cids []cid.Cid) []cid.Cid {
+	var missing []cid.Cid
+	for _, c := range cids {
+		if !store.Has(c) {
+			missing = append(missing, c)
+		}
+	}
+	return missing
+}
+
+// requestBlocks asks a peer for blocks of a shared file and stores each
+// one that matches its CID. The peer answers every requested block in
+// order with a uvarint length followed by the block, a zero length
+// meaning it does not hold the block or does not serve it to us.
+func (n *Node) requestBlocks(ctx context.Context, p peer.ID, root cid.Cid, cids []cid.Cid, t *transfer) error {
+	s, err := n.Host.NewStream(ctx, p, blockProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	defer resetOnCancel(ctx, s)()
+
+	req := blockRequest{Root: root.String()}
+	for _, c := range cids {
+		req.CIDs = append(req.CIDs, c.String())
+	}
+	s.SetDeadline(time.Now().Add(fileHeaderTimeout))
+	if err := json.NewEncoder(s).Encode(req); err != nil {
+		s.Reset()
+		return err
+	}
+	if err := s.CloseWrite(); err != nil {
+		s.Reset()
+		return err
+	}
+
+	reader := bufio.NewReader(s)
+	for _, c := range cids {
+		s.SetReadDeadline(time.Now().Add(fileChunkTimeout))
+		size, err := binary.ReadUvarint(reader)
+		if err != nil {
+			s.Reset()
+			return err
+		}
+		if size == 0 {
+			continue
+		}
+		if size > maxBlockSize {
+			s.Reset()
+			return errors.New("block too large")
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			s.Reset()
+			return err
+		}
+		if err := verifyBlock(c, data); err != nil {
+			s.Reset()
+			return err
+		}
+		if _, err := n.Blocks.Put(data); err != nil {
+			s.Reset()
+			return err
+		}
+		t.add(int64(len(data)))
+	}
+	return nil
+}
+
+// handleBlockRequest serves the blocks of a shared file to a peer that is
+// a member of a room the file was shared in.
+func (n *Node) handleBlockRequest(s network.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(fileHeaderTimeout))
+
+	if n.Blocks == nil {
+		s.Reset()
+		return
+	}
+
+	var req blockRequest
+	if err := json.NewDecoder(io.LimitReader(s, maxFileHeaderSize)).Decode(&req); err != nil {
+		s.Reset()
+		return
+	}
+
+	root, err := cid.Decode(req.Root)
+	if err != nil || !n.sharesFileWith(root, s.Conn().RemotePeer()) {
+		s.Reset()
+		return
+	}
+	allowed := n.fileBlocks(root)
+
+	// Blocks outside the requested file are answered as missing
+	cids := make([]cid.Cid, len(req.CIDs))
+	var size int64
+	for i, key := range req.CIDs {
+		if c, err := cid.Decode(key); err == nil && allowed[c] {
+			cids[i] = c
+			size += n.Blocks.Size(c)
+		}
+	}
+
+	// Track the upload until it completes, fails or is cancelled
+	t, ctx := n.Transfers.start(n.Context, fmt.Sprintf("%d blocks", len(cids)), s.Conn().RemotePeer(), TransferUpload, size)
+	defer n.Transfers.finish(t)
+	defer resetOnCancel(ctx, s)()
+
+	header := make([]byte, binary.MaxVarintLen64)
+	for _, c := range cids {
+		var data []byte
+		if c.Defined() {
+			data, _ = n.Blocks.Get(c)
+		}
+
+		s.SetWriteDeadline(time.Now().Add(fileChunkTimeout))
+		size := binary.PutUvarint(header, uint64(len(data)))
+		if _, err := s.Write(header[:size]); err != nil {
+			s.Reset()
+			return
+		}
+		if _, err := s.Write(data); err != nil {
+			s.Reset()
+			return
+		}
+		t.add(int64(len(data)))
+	}
+}
+
+// sharesFileWith reports whether a peer is subscribed to one of the
+// joined rooms a shared file was shared in.
+func (n *Node) sharesFileWith(root cid.Cid, p peer.ID) bool {
+	for _, room := range n.Blocks.RootRooms(root) {
+		if c := n.joinedRoom(room); c != nil && c.hasPeer(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileBlocks returns the manifest and chunk blocks of a stored shared file.
+func (n *Node) fileBlocks(root cid.Cid) map[cid.Cid]bool {
+	blocks := map[cid.Cid]bool{root: true}
+	data, err := n.Blocks.Get(root)
+	if err != nil {
+		return blocks
+	}
+
+	var manifest fileManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return blocks
+	}
+	for _, block := range manifest.Blocks {
+		if c, err := cid.Decode(block); err == nil {
+			blocks[c] = true
+		}
+	}
+	return blocks
+}
+
+// assembleFile writes the chunks of a fetched file into the download
+// directory and returns its path.
+func (n *Node) assembleFile(manifest fileManifest, chunks []cid.Cid) (string, error) {
+	dir, err := n.downloadDir()
+	if err != nil {
+		return "", err
+	}
+
+	partial, err := ioutil.TempFile(dir, ".peerchat-*.part")
+	if err != nil {
+		return "", fmt.Errorf("unable to create file: %w", err)
+	}
+	defer os.Remove(partial.Name())
+
+	for i, c := range chunks {
+		data, err := n.Blocks.Get(c)
+		if err == nil && int64(len(data)) != chunkLength(manifest.Size, i) {
+			err = errors.New("malformed manifest")
+		}
+		if err == nil {
+			_, err = partial.Write(data)
+		}
+		if err != nil {
+			partial.Close()
+			return "", err
+		}
+	}
+	if err := partial.Close(); err != nil {
+		return "", err
+	}
+	return saveDownload(partial.Name(), dir, manifest.Name)
+}
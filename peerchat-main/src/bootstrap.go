@@ -0,0 +1,105 @@
+package src
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// How often the bootstrap node logs its connection status
+const statusInterval = time.Minute
+
+// RunBootstrap runs the node headless as an always-on rendezvous point.
+// It relays the PubSub traffic of the given rooms and blocks until the
+// process receives an interrupt or termination signal.
+func RunBootstrap(node *Node, rooms []string) {
+	logrus.Infof("Bootstrap node %s listening on:", node.Host.ID().Pretty())
+	for _, addr := range node.FullAddrs() {
+		logrus.Infof("  %s", addr)
+	}
+
+	// A bootstrap node has to stay up even before it knows any peers, so
+	// discovery failures are only logged
+	if node.discoveryMode == DiscoveryMDNS || node.discoveryMode == DiscoveryBoth {
+		if err := node.StartMDNS(); err != nil {
+			logrus.WithError(err).Warn("Failed to start mDNS discovery")
+		}
+	}
+	if node.discoveryMode == DiscoveryDHT || node.discoveryMode == DiscoveryBoth {
+		go node.announceBootstrap()
+	}
+
+	for _, room := range rooms {
+		if room == "" {
+			continue
+		}
+		if err := node.relayRoom(room); err != nil {
+			logrus.WithError(err).Errorf("Failed to relay room '%s'", room)
+			continue
+		}
+		logrus.Infof("Relaying the '%s' chatroom", room)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	statusticker := time.NewTicker(statusInterval)
+	defer statusticker.Stop()
+
+	for {
+		select {
+		case <-statusticker.C:
+			logrus.Infof("Connected to %d peers", len(node.Host.Network().Peers()))
+		case sig := <-signals:
+			logrus.Infof("Received %s, shutting down", sig)
+			if err := node.Close(); err != nil {
+				logrus.WithError(err).Error("Failed to close node")
+			}
+			return
+		}
+	}
+}
+
+// announceBootstrap announces the node under the service CID in the
+// background. Announcing fails while the routing table is empty, such as
+// on the first node of a private network, so it is retried until it works.
+func (n *Node) announceBootstrap() {
+	for {
+		err := n.AnnounceServiceCID()
+		if err == nil {
+			return
+		}
+		logrus.WithError(err).Warn("Failed to announce bootstrap node, retrying")
+
+		select {
+		case <-time.After(statusInterval):
+		case <-n.Context.Done():
+			return
+		}
+	}
+}
+
+// relayRoom subscribes to a room's topic so the node takes part in its
+// gossip mesh, discarding the messages it receives.
+func (n *Node) relayRoom(room string) error {
+	topic, err := n.PubSub.Join(roomTopic(room))
+	if err != nil {
+		return err
+	}
+	subscription, err := topic.Subscribe()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			if _, err := subscription.Next(n.Context); err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
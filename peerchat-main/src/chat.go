@@ -2,16 +2,17 @@ package src
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/cipher"
+	"errors"
 	"fmt"
-	"io"
-	"os"
 	"os/exec"
-	"path/filepath"
 	"runtime"
+	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
 	"github.com/sirupsen/logrus"
 )
 
@@ -23,30 +24,94 @@ type ChatRoom struct {
 	OutgoingMessages chan string
 	LogChannel       chan logEntry
 
+	// Backlog holds the stored messages replayed when the room was joined
+	Backlog []historyRecord
+	// CatchUpMessages delivers batches of history fetched from room peers
+	CatchUpMessages chan []historyRecord
+
 	RoomName  string
 	Username  string
 	hostID    peer.ID
 	cancelCtx context.CancelFunc
 	roomCtx   context.Context
+	topicName string
 	topic     *pubsub.Topic
-	sub       *pubsub.Subscription
-}
 
-type FileChunkMessage struct {
-	FileName string
-	Chunk    []byte
+	// Key under which the room history is stored and served
+	historyKey string
+	// Payload cipher and key of a private room, nil for public rooms
+	roomCipher cipher.AEAD
+	roomKey    []byte
+	sub        *pubsub.Subscription
+
+	// IDs of the messages already shown, used to deduplicate catch-up history
+	seen      map[string]bool
+	seenMutex sync.Mutex
+
+	// Lamport clock of the room, and received messages held back so they
+	// are delivered in order
+	clock      uint64
+	clockMutex sync.Mutex
+	held       []heldMessage
+	heldWake   chan struct{}
+	heldMutex  sync.Mutex
+	listenDone chan struct{}
+
+	// Messages delivered or loaded from history, for replies and threads
+	messages *messageIndex
+
+	// Last name used by each verified sender, used to address peers by name
+	senders      map[peer.ID]string
+	clashes      map[string]bool
+	sendersMutex sync.Mutex
+
+	// Last heartbeat of each room peer, and the local user's own state
+	presence      map[peer.ID]presenceInfo
+	lastActive    time.Time
+	away          bool
+	presenceMutex sync.Mutex
+
+	// Wire version last used by each room peer, and peers already warned
+	// about sending messages of a newer protocol version
+	peerWires  map[peer.ID]int
+	newerPeers map[peer.ID]bool
+	wireMutex  sync.Mutex
 }
 
 // chatMsg represents a message within the chat.
 type chatMsg struct {
-	Text        string `json:"text"`
-	SenderID    string `json:"sender_id"`
-	SenderName  string `json:"sender_name"`
-	MsgType     string `json:"msg_type"` // "text" or "file"
-	FileName    string `json:"file_name,omitempty"`
-	ChunkIndex  int    `json:"chunk_index,omitempty"`
-	TotalChunks int    `json:"total_chunks,omitempty"`
-	ChunkData   []byte `json:"chunk_data,omitempty"`
+	// ID is chosen by the sender, Time is the sender's wall clock in Unix
+	// milliseconds and Clock the sender's Lamport clock of the room
+	ID    string `json:"id,omitempty"`
+	Time  int64  `json:"time,omitempty"`
+	Clock uint64 `json:"clock,omitempty"`
+
+	// ReplyTo is the ID of the message a text message answers
+	ReplyTo string `json:"reply_to,omitempty"`
+	// Target is the ID of the message an edit, retraction or reaction
+	// applies to
+	Target string `json:"target,omitempty"`
+
+	Text       string     `json:"text"`
+	SenderID   string     `json:"sender_id"`
+	SenderName string     `json:"sender_name"`
+	MsgType    string     `json:"msg_type"` // "text", "offer", "edit", "retract", "react" or "presence"
+	Offer      *fileOffer `json:"offer,omitempty"`
+	Status     string     `json:"status,omitempty"`
+	Version    string     `json:"version,omitempty"`
+	// Wire is the wire version of the sender, set on receipt for binary
+	// envelopes and sent in JSON so peers know the binary one is read
+	Wire int `json:"wire,omitempty"`
+
+	// Verified is set on receipt when SenderID matches the signed PubSub sender
+	Verified bool `json:"-"`
+	// Self is set on receipt for our own messages
+	Self bool `json:"-"`
+	// Edited and Retracted are set once the sender changed the message
+	Edited    bool `json:"-"`
+	Retracted bool `json:"-"`
+	// Reactions are the reactions received for the message so far
+	Reactions []reaction `json:"-"`
 }
 
 // logEntry is used for internal logging of chat events.
@@ -57,16 +122,35 @@ type logEntry struct {
 
 // JoinRoom initializes and returns a ChatRoom instance.
 func JoinRoom(node *Node, username, room string) (*ChatRoom, error) {
+	if room == "" {
+		room = "lobby"
+	}
+	return joinRoom(node, username, room, roomTopic(room), nil, nil)
+}
+
+// joinRoom joins a room on the given topic, encrypting its payloads
+// with roomCipher when the room is private.
+func joinRoom(node *Node, username, room, topicName string, roomCipher cipher.AEAD, roomKey []byte) (*ChatRoom, error) {
 
 	if username == "" {
 		username = "guest"
 	}
-	if room == "" {
-		room = "lobby"
+
+	// Private rooms are stored by topic so they never mix with a public
+	// room of the same name
+	historyKey := room
+	if roomCipher != nil {
+		historyKey = topicName
+	}
+
+	// A room can only be joined once per node, joining it again returns
+	// the existing subscription
+	if existing := node.joinedRoom(historyKey); existing != nil {
+		return existing, nil
 	}
 
 	// Set up the PubSub topic for the chat room
-	topic, err := node.PubSub.Join(fmt.Sprintf("chatroom-%s", room))
+	topic, err := node.PubSub.Join(topicName)
 	if err != nil {
 		return nil, err
 	}
@@ -86,86 +170,86 @@ func JoinRoom(node *Node, username, room string) (*ChatRoom, error) {
 		IncomingMessages: make(chan chatMsg),
 		OutgoingMessages: make(chan string),
 		LogChannel:       make(chan logEntry),
+		CatchUpMessages:  make(chan []historyRecord),
 		RoomName:         room,
 		Username:         username,
 		hostID:           node.Host.ID(),
 		roomCtx:          ctx,
 		cancelCtx:        cancel,
+		topicName:        topicName,
 		topic:            topic,
+		historyKey:       historyKey,
+		roomCipher:       roomCipher,
+		roomKey:          roomKey,
 		sub:              subscription,
+		seen:             make(map[string]bool),
+		heldWake:         make(chan struct{}, 1),
+		listenDone:       make(chan struct{}),
+		messages:         newMessageIndex(),
+		senders:          make(map[peer.ID]string),
+		clashes:          make(map[string]bool),
+		presence:         make(map[peer.ID]presenceInfo),
+		lastActive:       time.Now(),
+		peerWires:        make(map[peer.ID]int),
+		newerPeers:       make(map[peer.ID]bool),
+	}
+
+	// Load the stored history of the room
+	if node.History != nil {
+		if err := node.History.Prune(historyKey); err != nil {
+			logrus.WithError(err).Warn("Failed to prune room history")
+		}
+		backlog, err := node.History.Replay(historyKey)
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to load room history")
+		}
+		for i := range backlog {
+			backlog[i].Message.Verified = backlog[i].Verified
+			backlog[i].Message.Self = backlog[i].Self
+			backlog[i].Message.Edited = backlog[i].Edited
+			backlog[i].Message.Retracted = backlog[i].Retracted
+			if backlog[i].Message.ID == "" {
+				backlog[i].Message.ID = backlog[i].ID
+			}
+			chat.observeClock(&backlog[i].Message)
+			chat.markSeen(backlog[i].ID)
+			chat.rememberSender(backlog[i].Message)
+
+			// Stored messages already carry the edits and retractions
+			// stored after them, reactions are applied as they are read
+			if isChange(backlog[i].Message) {
+				if backlog[i].Message.MsgType == "react" {
+					chat.applyChange(backlog[i].Message)
+				}
+				continue
+			}
+			if backlog[i].Message.ID != "" && !chat.messages.add(backlog[i].Message) {
+				continue
+			}
+			chat.Backlog = append(chat.Backlog, backlog[i])
+		}
 	}
 
 	// Start the subscription and publishing loops
 	go chat.listenForMessages()
+	go chat.releaseMessages()
 	go chat.publishMessages()
+	go chat.announcePresence()
+
+	// Serve our history to other peers and fetch what we missed
+	node.registerRoom(chat)
+	go chat.catchUpHistory()
 
 	return chat, nil
 }
 
-func (c *ChatRoom) SendFile(filePath string) error {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return fmt.Errorf("unable to open file: %w", err)
-	}
-	defer file.Close()
-
-	const maxFileSize = 100 * 1024 // 100 KB
-
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return err
-	}
-
-	if fileInfo.Size() > maxFileSize {
-		return fmt.Errorf("file size exceeds the maximum allowed size of %d bytes", maxFileSize)
-	}
-
-	fileName := filepath.Base(filePath)
-	const chunkSize = 4096 // 4KB
-	buf := make([]byte, chunkSize)
-	var chunkIndex int
-	var totalChunks int
-
-	// Get the total size of the file to calculate total chunks
-	totalChunks = int(fileInfo.Size()/chunkSize) + 1
-	c.LogChannel <- logEntry{Prefix: "info", Msg: fmt.Sprintf("Sending file %s in %d chunks", fileName, totalChunks)}
-	for {
-		n, err := file.Read(buf)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("error reading file: %w", err)
-		}
-		if n == 0 {
-			break
-		}
-
-		message := chatMsg{
-			SenderID:    c.hostID.Pretty(),
-			SenderName:  c.Username,
-			MsgType:     "file",
-			FileName:    fileName,
-			ChunkIndex:  chunkIndex,
-			TotalChunks: totalChunks,
-			ChunkData:   buf[:n],
-		}
-
-		data, err := json.Marshal(message)
-		if err != nil {
-			return fmt.Errorf("error marshaling file chunk: %w", err)
-		}
-		if err := c.topic.Publish(c.roomCtx, data); err != nil {
-			return fmt.Errorf("error publishing file chunk: %w", err)
-		}
-
-		chunkIndex++
-	}
-	return nil
+// roomTopic returns the PubSub topic name for a chat room.
+func roomTopic(room string) string {
+	return fmt.Sprintf("chatroom-%s", room)
 }
 
 // listenForMessages handles incoming messages from the PubSub topic.
 func (c *ChatRoom) listenForMessages() {
-	// Map to store file chunks received
-	fileChunks := make(map[string][][]byte)
-
 	for {
 		select {
 		case <-c.roomCtx.Done():
@@ -173,73 +257,107 @@ func (c *ChatRoom) listenForMessages() {
 		default:
 			msg, err := c.sub.Next(c.roomCtx)
 			if err != nil {
-				close(c.IncomingMessages)
-				c.LogChannel <- logEntry{Prefix: "error", Msg: "Subscription closed unexpectedly"}
+				close(c.listenDone)
+				// Leaving the room cancels the subscription on purpose
+				if c.roomCtx.Err() == nil {
+					c.LogChannel <- logEntry{Prefix: "error", Msg: "Subscription closed unexpectedly"}
+				}
 				return
 			}
 
-			if msg.ReceivedFrom == c.hostID {
+			// Messages of a private room that do not decrypt with the
+			// room key are silently ignored
+			parsedMsg, err := c.decodeMessage(msg.Data)
+			switch {
+			case errors.Is(err, errNewerProtocol):
+				c.warnNewerProtocol(msg.GetFrom())
 				continue
-			}
-
-			var parsedMsg chatMsg
-			if err := json.Unmarshal(msg.Data, &parsedMsg); err != nil {
+			case errors.Is(err, errUnreadablePayload):
+				continue
+			case err != nil:
 				c.LogChannel <- logEntry{Prefix: "error", Msg: "Failed to parse incoming message"}
 				continue
 			}
 
-			if parsedMsg.MsgType == "file" {
+			// The PubSub From field is covered by the message signature,
+			// while SenderID is only claimed by the payload
+			if !c.verifySender(msg.GetFrom(), &parsedMsg) {
+				continue
+			}
+			c.notePeerWire(msg.GetFrom(), parsedMsg)
 
-				// Handle file chunk
-				key := parsedMsg.FileName + parsedMsg.SenderID
-				if _, exists := fileChunks[key]; !exists {
-					fileChunks[key] = make([][]byte, parsedMsg.TotalChunks)
-				}
-				fileChunks[key][parsedMsg.ChunkIndex] = parsedMsg.ChunkData
-
-				// Check if all chunks are received
-				receivedAll := true
-				for _, chunk := range fileChunks[key] {
-					if chunk == nil {
-						receivedAll = false
-						break
-					}
+			// Heartbeats only update the list of present peers
+			if parsedMsg.MsgType == "presence" {
+				if msg.ReceivedFrom != c.hostID {
+					c.updatePresence(msg.GetFrom(), parsedMsg)
+					c.warnNameClash(parsedMsg, c.rememberSender(parsedMsg))
 				}
+				continue
+			}
 
-				if receivedAll {
-					// Assemble the file
-					go assembleAndSaveFile(parsedMsg.FileName, fileChunks[key])
-					delete(fileChunks, key)
+			// Message types this client does not know, such as the file
+			// chunks of older clients, are ignored
+			if parsedMsg.MsgType != "" && parsedMsg.MsgType != "text" && parsedMsg.MsgType != "offer" && !isChange(parsedMsg) {
+				continue
+			}
+
+			// Messages of older clients are identified by their envelope
+			if parsedMsg.ID == "" {
+				parsedMsg.ID = envelopeID(msg.Message)
+			}
+			c.observeClock(&parsedMsg)
+
+			// Our own messages come back with their signed envelope,
+			// which is what gets stored and served to other peers
+			if msg.ReceivedFrom == c.hostID {
+				if parsedMsg.MsgType != "offer" {
+					c.record(msg.Message, parsedMsg, true)
+					parsedMsg.Self = true
+					c.holdMessage(parsedMsg)
 				}
-			} else {
-				c.IncomingMessages <- parsedMsg
+				continue
 			}
 
+			// File offers are shown but not stored, they expire with
+			// the sender's session
+			if parsedMsg.MsgType == "offer" {
+				c.NodeHost.rememberOffer(msg.GetFrom(), parsedMsg.SenderName, parsedMsg.Offer)
+			} else {
+				c.record(msg.Message, parsedMsg, false)
+			}
+			c.warnNameClash(parsedMsg, c.rememberSender(parsedMsg))
+			c.holdMessage(parsedMsg)
 		}
 	}
 }
 
-func assembleAndSaveFile(fileName string, chunks [][]byte) {
-	filePath := filepath.Join(os.Getenv("HOME"), "Desktop", fileName)
-	file, err := os.Create(filePath)
-	if err != nil {
-		logrus.WithError(err).Error("Failed to create file")
-		return
-	}
-	defer file.Close()
-
-	for _, chunk := range chunks {
-		if _, err := file.Write(chunk); err != nil {
-			logrus.WithError(err).Error("Failed to write file chunk")
-			return
-		}
+// verifySender binds a message to the peer that signed it. Messages
+// claiming another peer's ID are dropped, messages without a claimed
+// ID are accepted but left unverified.
+func (c *ChatRoom) verifySender(from peer.ID, msg *chatMsg) bool {
+	signer := from.Pretty()
+
+	switch msg.SenderID {
+	case signer:
+		msg.Verified = true
+		return true
+	case "":
+		msg.SenderID = signer
+		msg.Verified = false
+		return true
+	default:
+		logrus.Warnf("Dropped message from %s claiming to be %s", signer, msg.SenderID)
+		c.LogChannel <- logEntry{Prefix: "warning", Msg: fmt.Sprintf("dropped message from %s impersonating %s", shortID(signer), peertext(shortID(msg.SenderID)))}
+		return false
 	}
+}
 
-	// Optionally, open the file
-	if err := openFile(filePath); err != nil {
-		logrus.WithError(err).Error("Failed to open file")
+// shortID returns the last 8 characters of a peer ID for display.
+func shortID(id string) string {
+	if len(id) <= 8 {
+		return id
 	}
-
+	return id[len(id)-8:]
 }
 
 func openFile(filePath string) error {
@@ -262,23 +380,58 @@ func (c *ChatRoom) publishMessages() {
 		case <-c.roomCtx.Done():
 			return
 		case msg := <-c.OutgoingMessages:
-			message := chatMsg{
-				Text:       msg,
-				SenderID:   c.hostID.Pretty(),
-				SenderName: c.Username,
+			if err := c.publishText(msg, ""); err != nil {
+				c.LogChannel <- logEntry{Prefix: "error", Msg: fmt.Sprintf("Failed to send message: %s", err)}
 			}
+		}
+	}
+}
 
-			data, err := json.Marshal(message)
-			if err != nil {
-				c.LogChannel <- logEntry{Prefix: "error", Msg: "Failed to serialize message"}
-				continue
-			}
+// publishText publishes a text message, answering the message with the
+// given ID unless it is empty.
+func (c *ChatRoom) publishText(text, replyTo string) error {
+	return c.publishMessage(chatMsg{
+		ReplyTo:    replyTo,
+		Text:       text,
+		SenderID:   c.hostID.Pretty(),
+		SenderName: c.Username,
+	})
+}
 
-			if err := c.topic.Publish(c.roomCtx, data); err != nil {
-				c.LogChannel <- logEntry{Prefix: "error", Msg: "Failed to publish message"}
-				continue
-			}
-		}
+// publishMessage stamps a message of the local user and publishes it to
+// the room.
+func (c *ChatRoom) publishMessage(message chatMsg) error {
+	c.markActive()
+	c.stamp(&message)
+
+	data, err := c.encodeMessage(message)
+	if err != nil {
+		return fmt.Errorf("unable to serialize message: %w", err)
+	}
+	if err := c.topic.Publish(c.roomCtx, data); err != nil {
+		return fmt.Errorf("unable to publish message: %w", err)
+	}
+	return nil
+}
+
+// record marks a message as seen and appends it, along with its signed
+// envelope, to the room history if history is enabled.
+func (c *ChatRoom) record(envelope *pb.Message, msg chatMsg, self bool) {
+	id := envelopeID(envelope)
+	c.markSeen(id)
+	if c.NodeHost.History == nil {
+		return
+	}
+
+	data, err := envelope.Marshal()
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to encode message envelope")
+		return
+	}
+
+	rec := historyRecord{ID: id, Time: time.Now(), Self: self, Verified: msg.Verified, Message: msg, Envelope: data}
+	if err := c.NodeHost.History.Append(c.historyKey, rec); err != nil {
+		logrus.WithError(err).Warn("Failed to store message history")
 	}
 }
 
@@ -289,7 +442,14 @@ func (c *ChatRoom) GetPeers() []peer.ID {
 
 // Leave gracefully shuts down the chat room by closing resources.
 func (c *ChatRoom) Leave() {
-	defer c.cancelCtx()
+	// Tell the room we are gone instead of letting our heartbeat expire
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	c.publishPresence(ctx, StatusOffline)
+	cancel()
+
+	c.cancelCtx()
+
+	c.NodeHost.unregisterRoom(c)
 
 	c.sub.Cancel()
 	c.topic.Close()
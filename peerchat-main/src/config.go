@@ -0,0 +1,105 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/pnet"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Config holds the settings that can be read from a JSON config file.
+// Any setting given on the command line overrides the file.
+type Config struct {
+	// Bootstrap is a list of multiaddrs (including /p2p/<id>) to bootstrap from
+	Bootstrap []string `json:"bootstrap"`
+	// PublicBootstrap adds the public IPFS bootstrap peers to the list
+	PublicBootstrap bool `json:"public_bootstrap"`
+	// SwarmKey is the path of a swarm.key file for a private network
+	SwarmKey string `json:"swarm_key"`
+
+	// ListenAddrs overrides the listen addresses derived from the settings below
+	ListenAddrs []string `json:"listen_addrs"`
+	// Port is the TCP and QUIC port to listen on, 0 picks a random port
+	Port int `json:"port"`
+	// IPv6 also listens on all IPv6 interfaces
+	IPv6 bool `json:"ipv6"`
+	// QUIC enables the QUIC transport
+	QUIC bool `json:"quic"`
+	// WebSocket enables the WebSocket transport
+	WebSocket bool `json:"websocket"`
+	// WebSocketPort is the TCP port for WebSocket connections
+	WebSocketPort int `json:"websocket_port"`
+	// Security lists the connection security protocols in order of preference
+	Security []string `json:"security"`
+}
+
+// DefaultConfig returns the settings used when no config file is given.
+func DefaultConfig() Config {
+	return Config{
+		PublicBootstrap: true,
+		Security:        []string{SecurityTLS},
+	}
+}
+
+// LoadConfig reads a JSON config file on top of the default settings.
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("unable to read config file: %w", err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("malformed config file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// ResolveBootstrapPeers parses the configured bootstrap multiaddrs and,
+// if requested, appends the public IPFS bootstrap peers.
+func ResolveBootstrapPeers(addrs []string, includePublic bool) ([]peer.AddrInfo, error) {
+	var maddrs []multiaddr.Multiaddr
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		maddr, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap address %q: %w", addr, err)
+		}
+		maddrs = append(maddrs, maddr)
+	}
+	if includePublic {
+		maddrs = append(maddrs, dht.DefaultBootstrapPeers...)
+	}
+
+	// Addresses of the same peer are merged into a single AddrInfo
+	peers, err := peer.AddrInfosFromP2pAddrs(maddrs...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bootstrap address: %w", err)
+	}
+	return peers, nil
+}
+
+// LoadSwarmKey reads a private network pre-shared key in the
+// go-ipfs swarm.key format.
+func LoadSwarmKey(path string) (pnet.PSK, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open swarm key: %w", err)
+	}
+	defer file.Close()
+
+	psk, err := pnet.DecodeV1PSK(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode swarm key: %w", err)
+	}
+	return psk, nil
+}
@@ -0,0 +1,222 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+// Protocol used for private one-to-one messages
+const dmProtocol = "/peerchat/dm/1.0.0"
+
+const (
+	// Deadline for delivering a direct message and reading its acknowledgement
+	dmTimeout = 15 * time.Second
+	// How long an incoming direct message waits for the UI before it is refused
+	dmDeliveryTimeout = 5 * time.Second
+	// Largest direct message accepted from a peer
+	maxDirectMessageSize = 64 * 1024
+)
+
+// directMsg is a private message exchanged over a direct stream.
+type directMsg struct {
+	Text       string    `json:"text"`
+	SenderName string    `json:"sender_name"`
+	Time       time.Time `json:"time"`
+	// Offer is set when the message offers a file
+	Offer *fileOffer `json:"offer,omitempty"`
+
+	// PeerID is the other side of the conversation, taken from the
+	// authenticated connection rather than the payload
+	PeerID peer.ID `json:"-"`
+	// Self is set for messages we sent
+	Self bool `json:"-"`
+}
+
+// dmAck acknowledges the delivery of a direct message.
+type dmAck struct {
+	Delivered bool   `json:"delivered"`
+	Error     string `json:"error,omitempty"`
+}
+
+// handleDirectMessage receives a direct message, hands it to the UI and
+// acknowledges whether it was delivered.
+func (n *Node) handleDirectMessage(s network.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(dmTimeout))
+
+	var msg directMsg
+	if err := json.NewDecoder(io.LimitReader(s, maxDirectMessageSize)).Decode(&msg); err != nil {
+		s.Reset()
+		return
+	}
+	msg.PeerID = s.Conn().RemotePeer()
+	msg.Self = false
+
+	ack := dmAck{Delivered: true}
+	select {
+	case n.DirectMessages <- msg:
+		n.rememberOffer(msg.PeerID, msg.SenderName, msg.Offer)
+		n.recordDirectMessage(msg)
+	case <-time.After(dmDeliveryTimeout):
+		ack = dmAck{Error: "recipient is not reading direct messages"}
+	}
+
+	if err := json.NewEncoder(s).Encode(ack); err != nil {
+		s.Reset()
+	}
+}
+
+// SendDirectMessage delivers a private message to a single peer and waits
+// for its acknowledgement.
+func (n *Node) SendDirectMessage(ctx context.Context, p peer.ID, senderName, text string) error {
+	return n.sendDirect(ctx, p, directMsg{Text: text, SenderName: senderName})
+}
+
+// sendDirect delivers a direct message and records it once acknowledged.
+func (n *Node) sendDirect(ctx context.Context, p peer.ID, msg directMsg) error {
+	ctx, cancel := context.WithTimeout(ctx, dmTimeout)
+	defer cancel()
+
+	s, err := n.Host.NewStream(ctx, p, dmProtocol)
+	if err != nil {
+		return fmt.Errorf("unable to reach peer: %w", err)
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(dmTimeout))
+
+	msg.Time = time.Now()
+	if err := json.NewEncoder(s).Encode(msg); err != nil {
+		s.Reset()
+		return err
+	}
+	if err := s.CloseWrite(); err != nil {
+		s.Reset()
+		return err
+	}
+
+	var ack dmAck
+	if err := json.NewDecoder(io.LimitReader(s, 4096)).Decode(&ack); err != nil {
+		s.Reset()
+		return fmt.Errorf("no delivery acknowledgement: %w", err)
+	}
+	if !ack.Delivered {
+		return fmt.Errorf("message not delivered: %s", ack.Error)
+	}
+
+	msg.PeerID = p
+	msg.Self = true
+	n.recordDirectMessage(msg)
+	return nil
+}
+
+// recordDirectMessage stores a direct message in the conversation log of
+// the other peer, if direct message history is enabled.
+func (n *Node) recordDirectMessage(msg directMsg) {
+	if n.DirectHistory == nil {
+		return
+	}
+
+	senderID := msg.PeerID.Pretty()
+	if msg.Self {
+		senderID = n.Host.ID().Pretty()
+	}
+	rec := historyRecord{
+		Time:     msg.Time,
+		Self:     msg.Self,
+		Verified: true,
+		Message:  chatMsg{Text: msg.Text, SenderID: senderID, SenderName: msg.SenderName},
+	}
+	if err := n.DirectHistory.Append(msg.PeerID.Pretty(), rec); err != nil {
+		logrus.WithError(err).Warn("Failed to store direct message")
+	}
+}
+
+// ResolvePeer finds a peer by full peer ID, by the short ID shown in the
+// peer list, by the name it last used in this room, or by name#shortid.
+func (c *ChatRoom) ResolvePeer(ref string) (peer.ID, error) {
+	if id, err := peer.Decode(ref); err == nil {
+		return id, nil
+	}
+
+	// A disambiguated name matches on both the name and the ID suffix
+	if i := strings.LastIndex(ref, "#"); i > 0 {
+		name, suffix := ref[:i], ref[i+1:]
+		c.sendersMutex.Lock()
+		defer c.sendersMutex.Unlock()
+		for p, sender := range c.senders {
+			if sender == name && strings.HasSuffix(p.Pretty(), suffix) {
+				return p, nil
+			}
+		}
+		return "", fmt.Errorf("no peer named '%s' in this room", ref)
+	}
+
+	var matches []peer.ID
+	for _, p := range c.topic.ListPeers() {
+		if strings.HasSuffix(p.Pretty(), ref) {
+			matches = append(matches, p)
+		}
+	}
+	if len(matches) == 0 {
+		c.sendersMutex.Lock()
+		for p, name := range c.senders {
+			if name == ref {
+				matches = append(matches, p)
+			}
+		}
+		c.sendersMutex.Unlock()
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no peer named '%s' in this room", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", errors.New("several peers match, use a longer peer ID")
+	}
+}
+
+// rememberSender keeps the last name used by each verified sender. The
+// first time the name is seen in use by two peers, the other peer is
+// returned so the clash can be reported.
+func (c *ChatRoom) rememberSender(msg chatMsg) peer.ID {
+	if !msg.Verified {
+		return ""
+	}
+	id, err := peer.Decode(msg.SenderID)
+	if err != nil {
+		return ""
+	}
+
+	c.sendersMutex.Lock()
+	defer c.sendersMutex.Unlock()
+	c.senders[id] = msg.SenderName
+
+	for p, name := range c.senders {
+		if p != id && name == msg.SenderName && !c.clashes[name] {
+			c.clashes[name] = true
+			return p
+		}
+	}
+	return ""
+}
+
+// warnNameClash reports that two peers of the room use the same name.
+func (c *ChatRoom) warnNameClash(msg chatMsg, other peer.ID) {
+	if other == "" {
+		return
+	}
+	name := peertext(msg.SenderName)
+	c.LogChannel <- logEntry{Prefix: "warning", Msg: fmt.Sprintf("'%s' is used by both %s and %s, they are shown as %s#<id>",
+		name, shortID(other.Pretty()), peertext(shortID(msg.SenderID)), name)}
+}
@@ -0,0 +1,194 @@
+package src
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Edit publishes a new text for one of our earlier messages.
+func (c *ChatRoom) Edit(id, text string) error {
+	if err := c.checkOwnMessage(id); err != nil {
+		return err
+	}
+	return c.publishChange("edit", id, text)
+}
+
+// Retract publishes the deletion of one of our earlier messages.
+func (c *ChatRoom) Retract(id string) error {
+	if err := c.checkOwnMessage(id); err != nil {
+		return err
+	}
+	return c.publishChange("retract", id, "")
+}
+
+// checkOwnMessage returns an error unless the message with the given ID
+// is a text message of the local user that can still be changed.
+func (c *ChatRoom) checkOwnMessage(id string) error {
+	msg, ok := c.messages.get(id)
+	switch {
+	case !ok:
+		return fmt.Errorf("no message #%s in this room", messageRef(id))
+	case msg.SenderID != c.hostID.Pretty():
+		return fmt.Errorf("message #%s was sent by someone else", messageRef(id))
+	case msg.Retracted:
+		return fmt.Errorf("message #%s was deleted", messageRef(id))
+	case msg.MsgType != "" && msg.MsgType != "text":
+		return fmt.Errorf("message #%s is not a text message", messageRef(id))
+	}
+	return nil
+}
+
+// publishChange publishes an edit, retraction or reaction to a message.
+func (c *ChatRoom) publishChange(msgType, target, text string) error {
+	return c.publishMessage(chatMsg{
+		Target:     target,
+		Text:       text,
+		SenderID:   c.hostID.Pretty(),
+		SenderName: c.Username,
+		MsgType:    msgType,
+	})
+}
+
+// isChange reports whether a message edits, retracts or reacts to an
+// earlier one.
+func isChange(msg chatMsg) bool {
+	return msg.MsgType == "edit" || msg.MsgType == "retract" || msg.MsgType == "react"
+}
+
+// changeMessage applies an edit or retraction to the message it targets.
+// Only the sender of a text message can change it, and both sender IDs
+// are bound to the PubSub signature on receipt. The target is the first
+// message seen with its ID, so a peer reusing the ID cannot claim it. It
+// reports whether the message changed.
+func changeMessage(target *chatMsg, change chatMsg) bool {
+	if target.SenderID == "" || target.SenderID != change.SenderID || target.Retracted {
+		return false
+	}
+	if target.MsgType != "" && target.MsgType != "text" {
+		return false
+	}
+
+	switch change.MsgType {
+	case "edit":
+		target.Text = change.Text
+		target.Edited = true
+	case "retract":
+		target.Text = ""
+		target.Retracted = true
+		target.Reactions = nil
+	default:
+		return false
+	}
+	return true
+}
+
+// applyChange applies a received edit, retraction or reaction to the
+// indexed message it targets, and edits and retractions to the stored
+// history. It reports whether the indexed message changed.
+func (c *ChatRoom) applyChange(change chatMsg) bool {
+	// Reactions are stored as records of their own and applied on replay
+	apply := changeMessage
+	if change.MsgType == "react" {
+		apply = addReaction
+	} else {
+		c.amendHistory(change)
+	}
+
+	changed := c.messages.update(change.Target, func(target *chatMsg) bool {
+		return apply(target, change)
+	})
+	if !changed {
+		logrus.Debugf("Ignored %s of message %s from %s", change.MsgType, change.Target, change.SenderID)
+		return false
+	}
+	return true
+}
+
+// amendHistory applies an edit or retraction to the stored message it
+// targets. Retracted messages lose their text and their signed envelope,
+// and so do the stored edits of them, so they are no longer served to
+// peers.
+func (c *ChatRoom) amendHistory(change chatMsg) {
+	if c.NodeHost.History == nil {
+		return
+	}
+
+	var target chatMsg
+	err := c.NodeHost.History.Amend(c.historyKey, change.Target, func(record *historyRecord) bool {
+		record.Message.Edited = record.Edited
+		record.Message.Retracted = record.Retracted
+		changed := changeMessage(&record.Message, change)
+		if changed {
+			updateRecord(record, record.Message)
+		}
+		target = record.Message
+		return changed
+	})
+
+	// Edits stored before the retraction, or received after it, still
+	// carry the text
+	if err == nil && target.Retracted {
+		err = c.NodeHost.History.AmendChanges(c.historyKey, change.Target, func(record *historyRecord) bool {
+			return redactEdit(record, target)
+		})
+	}
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to update message history")
+	}
+}
+
+// redactEdit drops the text and signed envelope of a stored edit of a
+// retracted message by its sender. It reports whether the record changed.
+func redactEdit(record *historyRecord, target chatMsg) bool {
+	if record.Message.MsgType != "edit" || record.Message.SenderID != target.SenderID {
+		return false
+	}
+	if record.Message.Text == "" && record.Envelope == nil {
+		return false
+	}
+	record.Message.Text = ""
+	record.Envelope = nil
+	return true
+}
+
+// updateRecord stores the current state of a message in its record.
+func updateRecord(record *historyRecord, msg chatMsg) {
+	record.Message = msg
+	record.Edited = msg.Edited
+	record.Retracted = msg.Retracted
+	if msg.Retracted {
+		record.Envelope = nil
+	}
+}
+
+// applyHistoryChanges applies the edits, retractions and reactions among
+// ordered records fetched from peers. Messages reusing the ID of an
+// earlier one are dropped. It returns the records to store, with those of
+// changed messages updated so they are stored that way, and the records
+// that are not changes, to be shown.
+func (c *ChatRoom) applyHistoryChanges(records []historyRecord) (kept, shown []historyRecord) {
+	for _, record := range records {
+		if isChange(record.Message) {
+			c.applyChange(record.Message)
+		} else if record.Message.ID != "" && !c.messages.add(record.Message) {
+			logrus.Debugf("Dropped history message %s from %s reusing a known ID", record.Message.ID, record.Message.SenderID)
+			continue
+		}
+		kept = append(kept, record)
+	}
+
+	for i := range kept {
+		if isChange(kept[i].Message) {
+			if target, ok := c.messages.get(kept[i].Message.Target); ok && target.Retracted {
+				redactEdit(&kept[i], target)
+			}
+			continue
+		}
+		if msg, ok := c.messages.get(kept[i].Message.ID); ok {
+			updateRecord(&kept[i], msg)
+		}
+		shown = append(shown, kept[i])
+	}
+	return kept, shown
+}
@@ -0,0 +1,110 @@
+package src
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRoom returns a room without history holding a message of alice.
+func newTestRoom() *ChatRoom {
+	c := &ChatRoom{NodeHost: &Node{}, messages: newMessageIndex()}
+	c.messages.add(chatMsg{ID: "a1b2", Text: "hello", SenderID: "QmAlice", MsgType: "text"})
+	return c
+}
+
+func TestEditBySender(t *testing.T) {
+	c := newTestRoom()
+
+	if !c.applyChange(chatMsg{ID: "c3d4", Target: "a1b2", Text: "hi", SenderID: "QmAlice", MsgType: "edit"}) {
+		t.Fatal("edit by the sender was not applied")
+	}
+	msg, _ := c.messages.get("a1b2")
+	if msg.Text != "hi" || !msg.Edited {
+		t.Errorf("got %q edited %v, want %q edited", msg.Text, msg.Edited, "hi")
+	}
+}
+
+func TestEditByOtherPeer(t *testing.T) {
+	c := newTestRoom()
+
+	if c.applyChange(chatMsg{ID: "c3d4", Target: "a1b2", Text: "pwned", SenderID: "QmMallory", MsgType: "edit"}) {
+		t.Error("edit by another peer was applied")
+	}
+	if c.applyChange(chatMsg{ID: "e5f6", Target: "a1b2", SenderID: "QmMallory", MsgType: "retract"}) {
+		t.Error("retraction by another peer was applied")
+	}
+	if msg, _ := c.messages.get("a1b2"); msg.Text != "hello" || msg.Edited || msg.Retracted {
+		t.Errorf("message changed to %+v", msg)
+	}
+}
+
+func TestEditAfterReusedID(t *testing.T) {
+	c := newTestRoom()
+
+	// Another peer reuses the ID, then edits and retracts "its" message
+	if c.messages.add(chatMsg{ID: "a1b2", Text: "pwned", SenderID: "QmMallory", MsgType: "text"}) {
+		t.Error("message reusing a known ID was indexed")
+	}
+	if c.applyChange(chatMsg{ID: "c3d4", Target: "a1b2", Text: "pwned", SenderID: "QmMallory", MsgType: "edit"}) {
+		t.Error("edit by the peer reusing the ID was applied")
+	}
+	if c.applyChange(chatMsg{ID: "e5f6", Target: "a1b2", SenderID: "QmMallory", MsgType: "retract"}) {
+		t.Error("retraction by the peer reusing the ID was applied")
+	}
+
+	msg, _ := c.messages.get("a1b2")
+	if msg.SenderID != "QmAlice" || msg.Text != "hello" || msg.Edited || msg.Retracted {
+		t.Errorf("message changed to %+v", msg)
+	}
+
+	// The original sender can still edit it
+	if !c.applyChange(chatMsg{ID: "a7b8", Target: "a1b2", Text: "hi", SenderID: "QmAlice", MsgType: "edit"}) {
+		t.Error("edit by the original sender was not applied")
+	}
+}
+
+func TestRetractRedactsStoredEdits(t *testing.T) {
+	store, err := OpenHistoryStore(t.TempDir(), HistoryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &ChatRoom{NodeHost: &Node{History: store}, historyKey: "room", messages: newMessageIndex()}
+
+	// Messages are stored on receipt and applied once released
+	receive := func(msg chatMsg) {
+		t.Helper()
+		record := historyRecord{ID: "env-" + msg.ID, Time: time.Now(), Verified: true, Message: msg, Envelope: []byte("signed " + msg.Text)}
+		if err := store.Append(c.historyKey, record); err != nil {
+			t.Fatal(err)
+		}
+		if isChange(msg) {
+			c.applyChange(msg)
+		} else {
+			c.messages.add(msg)
+		}
+	}
+	receive(chatMsg{ID: "a1b2", Text: "secret", SenderID: "QmAlice", MsgType: "text"})
+	receive(chatMsg{ID: "c3d4", Target: "a1b2", Text: "secret too", SenderID: "QmAlice", MsgType: "edit"})
+	receive(chatMsg{ID: "e5f6", Target: "a1b2", SenderID: "QmAlice", MsgType: "retract"})
+	receive(chatMsg{ID: "a7b8", Target: "a1b2", Text: "secret late", SenderID: "QmAlice", MsgType: "edit"})
+
+	records, err := store.Since(c.historyKey, time.Time{}, "", maxHistoryResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("got %d records, want 4", len(records))
+	}
+	for _, record := range records {
+		if strings.Contains(record.Message.Text, "secret") || strings.Contains(string(record.Envelope), "secret") {
+			t.Errorf("record %s still carries the deleted text: %+v", record.ID, record)
+		}
+	}
+	if !records[0].Retracted {
+		t.Error("retracted message is not marked as retracted")
+	}
+	if records[2].Envelope == nil {
+		t.Error("retraction lost its envelope")
+	}
+}
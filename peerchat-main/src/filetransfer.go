@@ -0,0 +1,707 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+// Protocol used to download an offered file straight from its sender
+const fileProtocol = "/peerchat/file/1.0.0"
+
+const (
+	// How long an offered file can be downloaded
+	fileOfferLifetime = time.Hour
+	// Size of the chunks a file is hashed and transferred in
+	fileChunkSize = 1024 * 1024
+	// Deadline for exchanging the file request and response header
+	fileHeaderTimeout = 30 * time.Second
+	// Deadline for transferring a single chunk
+	fileChunkTimeout = time.Minute
+	// How many times an interrupted download is resumed automatically
+	fileTransferAttempts = 3
+	// Pause before resuming an interrupted download
+	fileRetryDelay = 2 * time.Second
+	// How long an incomplete download is kept for resuming
+	partialDownloadLifetime = 24 * time.Hour
+	// Largest file request or response header accepted
+	maxFileHeaderSize = 1024 * 1024
+	// Longest file name given to a downloaded file, in bytes
+	maxFileNameLength = 200
+)
+
+// Largest offered file accepted unless configured otherwise
+const DefaultMaxFileSize = 1024 * 1024 * 1024
+
+// DownloadOptions controls where offered files are saved and which
+// files are accepted.
+type DownloadOptions struct {
+	// Dir is the directory downloaded files are saved to
+	Dir string
+	// MaxSize refuses offers of larger files, 0 is unlimited
+	MaxSize int64
+	// AutoOpen opens each downloaded file with the system's default
+	// application, off unless explicitly enabled
+	AutoOpen bool
+}
+
+// fileOffer announces a file that peers can download from its sender.
+// Hash is the SHA-256 of the concatenated chunk hashes, so it covers the
+// whole content and lets each chunk be checked on its own.
+type fileOffer struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// sharedFile is a file we offered, waiting to be downloaded.
+type sharedFile struct {
+	offer       fileOffer
+	path        string
+	chunkHashes [][]byte
+	// room limits downloads to its peers, nil for a direct offer
+	room *ChatRoom
+	// recipient is the only peer allowed to download a direct offer
+	recipient peer.ID
+	expires   time.Time
+}
+
+// pendingOffer is a file offered to us that can be accepted.
+type pendingOffer struct {
+	offer      fileOffer
+	from       peer.ID
+	senderName string
+	expires    time.Time
+}
+
+// fileRequest asks the sender of an offer for the file.
+type fileRequest struct {
+	OfferID string `json:"offer_id"`
+}
+
+// fileResponse describes the chunks of a requested file, or explains
+// why it is refused.
+type fileResponse struct {
+	Size        int64    `json:"size"`
+	ChunkSize   int64    `json:"chunk_size"`
+	ChunkHashes [][]byte `json:"chunk_hashes"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// chunkRequest lists the chunks still missing on the receiving side.
+// The sender streams them back to back in the requested order.
+type chunkRequest struct {
+	Chunks []int `json:"chunks"`
+}
+
+// errTransferRefused marks download failures that retrying cannot fix.
+var errTransferRefused = errors.New("transfer refused")
+
+// errTransferCancelled is returned by transfers stopped with /cancel.
+var errTransferCancelled = errors.New("transfer cancelled")
+
+// shareFile hashes a local file, registers it for download and returns
+// its offer.
+func (n *Node) shareFile(path string, room *ChatRoom, recipient peer.ID) (fileOffer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return fileOffer{}, fmt.Errorf("unable to open file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fileOffer{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return fileOffer{}, errors.New("not a regular file")
+	}
+
+	chunkHashes, err := hashChunks(file, info.Size())
+	if err != nil {
+		return fileOffer{}, fmt.Errorf("unable to hash file: %w", err)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fileOffer{}, err
+	}
+	offer := fileOffer{
+		ID:   hex.EncodeToString(id),
+		Name: filepath.Base(path),
+		Size: info.Size(),
+		Hash: contentHash(chunkHashes),
+	}
+
+	n.filesMutex.Lock()
+	defer n.filesMutex.Unlock()
+	n.shared[offer.ID] = &sharedFile{
+		offer:       offer,
+		path:        path,
+		chunkHashes: chunkHashes,
+		room:        room,
+		recipient:   recipient,
+		expires:     time.Now().Add(fileOfferLifetime),
+	}
+	return offer, nil
+}
+
+// hashChunks returns the SHA-256 hash of every chunk of a file.
+func hashChunks(file io.Reader, size int64) ([][]byte, error) {
+	var hashes [][]byte
+	for remaining := size; remaining > 0; remaining -= fileChunkSize {
+		hash := sha256.New()
+		if _, err := io.CopyN(hash, file, minSize(remaining, fileChunkSize)); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash.Sum(nil))
+	}
+	return hashes, nil
+}
+
+// contentHash returns the content hash of a file from its chunk hashes.
+func contentHash(chunkHashes [][]byte) string {
+	digest := sha256.Sum256(bytes.Join(chunkHashes, nil))
+	return hex.EncodeToString(digest[:])
+}
+
+// SendFile offers a file to everyone in the room. Peers that accept the
+// offer download it over a direct stream.
+func (c *ChatRoom) SendFile(filePath string) error {
+	offer, err := c.NodeHost.shareFile(filePath, c, "")
+	if err != nil {
+		return err
+	}
+
+	message := chatMsg{
+		SenderID:   c.hostID.Pretty(),
+		SenderName: c.Username,
+		MsgType:    "offer",
+		Offer:      &offer,
+	}
+	c.stamp(&message)
+	data, err := c.encodeMessage(message)
+	if err != nil {
+		return fmt.Errorf("error encoding file offer: %w", err)
+	}
+	if err := c.topic.Publish(c.roomCtx, data); err != nil {
+		return fmt.Errorf("error publishing file offer: %w", err)
+	}
+	return nil
+}
+
+// SendFileTo offers a file to a single peer with a direct message.
+func (n *Node) SendFileTo(ctx context.Context, p peer.ID, senderName, filePath string) error {
+	offer, err := n.shareFile(filePath, nil, p)
+	if err != nil {
+		return err
+	}
+
+	msg := directMsg{
+		Text:       fmt.Sprintf("offered %s (%s)", offer.Name, formatSize(offer.Size)),
+		SenderName: senderName,
+		Offer:      &offer,
+	}
+	return n.sendDirect(ctx, p, msg)
+}
+
+// rememberOffer keeps a file offered to us so it can be accepted later.
+func (n *Node) rememberOffer(from peer.ID, senderName string, offer *fileOffer) {
+	if offer == nil || offer.ID == "" {
+		return
+	}
+
+	n.filesMutex.Lock()
+	defer n.filesMutex.Unlock()
+	n.offered[offer.ID] = &pendingOffer{
+		offer:      *offer,
+		from:       from,
+		senderName: senderName,
+		expires:    time.Now().Add(fileOfferLifetime),
+	}
+}
+
+// AcceptsFileSize reports whether offers of files of the given size are
+// accepted.
+func (n *Node) AcceptsFileSize(size int64) bool {
+	return n.downloads.MaxSize <= 0 || size <= n.downloads.MaxSize
+}
+
+// DeclineFile forgets a file offered to us.
+func (n *Node) DeclineFile(offerID string) error {
+	n.filesMutex.Lock()
+	defer n.filesMutex.Unlock()
+
+	if _, ok := n.offered[offerID]; !ok {
+		return fmt.Errorf("no file offer with ID '%s'", offerID)
+	}
+	delete(n.offered, offerID)
+	return nil
+}
+
+// AcceptFile downloads an offered file from its sender and returns the
+// path it was saved to. Every chunk is checked against the offer's
+// content hash. An interrupted download resumes from the chunks already
+// received, both automatically and when the offer is accepted again.
+func (n *Node) AcceptFile(ctx context.Context, offerID string) (string, error) {
+	n.filesMutex.Lock()
+	for id, pending := range n.offered {
+		if time.Now().After(pending.expires) {
+			delete(n.offered, id)
+		}
+	}
+	pending, ok := n.offered[offerID]
+	n.filesMutex.Unlock()
+	if !ok {
+		return "", fmt.Errorf("no file offer with ID '%s'", offerID)
+	}
+	if !n.AcceptsFileSize(pending.offer.Size) {
+		return "", fmt.Errorf("%s exceeds the maximum accepted size of %s", formatSize(pending.offer.Size), formatSize(n.downloads.MaxSize))
+	}
+
+	dir, err := n.downloadDir()
+	if err != nil {
+		return "", err
+	}
+
+	path, err := n.trackDownload(ctx, pending.offer.Name, pending.from, pending.offer.Size, func(ctx context.Context, t *transfer) (path string, err error) {
+		for attempt := 1; attempt <= fileTransferAttempts; attempt++ {
+			path, err = n.downloadOffer(ctx, dir, pending, t)
+			if err == nil || errors.Is(err, errTransferRefused) || ctx.Err() != nil {
+				break
+			}
+			logrus.WithError(err).Debugf("Download of %s interrupted, attempt %d", pending.offer.Name, attempt)
+
+			select {
+			case <-time.After(fileRetryDelay):
+			case <-ctx.Done():
+			}
+		}
+		return path, err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	n.filesMutex.Lock()
+	delete(n.offered, offerID)
+	n.filesMutex.Unlock()
+
+	n.openDownload(path)
+	return path, nil
+}
+
+// downloadOffer makes a single attempt at downloading the missing chunks
+// of an offer into its partial file, and moves the file into place once
+// every chunk is verified.
+func (n *Node) downloadOffer(ctx context.Context, dir string, pending *pendingOffer, t *transfer) (string, error) {
+	s, err := n.Host.NewStream(ctx, pending.from, fileProtocol)
+	if err != nil {
+		return "", fmt.Errorf("unable to reach sender: %w", err)
+	}
+	defer s.Close()
+	defer resetOnCancel(ctx, s)()
+
+	s.SetDeadline(time.Now().Add(fileHeaderTimeout))
+	encoder := json.NewEncoder(s)
+	if err := encoder.Encode(fileRequest{OfferID: pending.offer.ID}); err != nil {
+		s.Reset()
+		return "", err
+	}
+
+	decoder := json.NewDecoder(io.LimitReader(s, maxFileHeaderSize))
+	var resp fileResponse
+	if err := decoder.Decode(&resp); err != nil {
+		s.Reset()
+		return "", fmt.Errorf("no response from sender: %w", err)
+	}
+	if resp.Error != "" {
+		return "", fmt.Errorf("%w: %s", errTransferRefused, peertext(resp.Error))
+	}
+
+	// The chunk hashes must add up to the content hash of the offer
+	if resp.Size != pending.offer.Size || resp.ChunkSize != fileChunkSize ||
+		int64(len(resp.ChunkHashes)) != chunkCount(resp.Size) || contentHash(resp.ChunkHashes) != pending.offer.Hash {
+		s.Reset()
+		return "", fmt.Errorf("%w: file does not match its offer", errTransferRefused)
+	}
+
+	// Keep the partial file by content hash, so a download of the same
+	// content resumes even under a new offer
+	partialPath := filepath.Join(dir, ".peerchat-"+pending.offer.Hash[:16]+".part")
+	partial, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		s.Reset()
+		return "", fmt.Errorf("unable to create file: %w", err)
+	}
+	defer partial.Close()
+
+	missing, err := missingChunks(partial, resp.ChunkHashes, resp.Size)
+	if err != nil {
+		s.Reset()
+		return "", err
+	}
+	t.resume(resp.Size - chunksLength(resp.Size, missing))
+
+	if err := encoder.Encode(chunkRequest{Chunks: missing}); err != nil {
+		s.Reset()
+		return "", err
+	}
+	if err := s.CloseWrite(); err != nil {
+		s.Reset()
+		return "", err
+	}
+
+	// The decoder may already hold the start of the chunk data
+	data := io.MultiReader(decoder.Buffered(), s)
+	buf := make([]byte, fileChunkSize)
+	for _, i := range missing {
+		chunk := buf[:chunkLength(resp.Size, i)]
+
+		s.SetReadDeadline(time.Now().Add(fileChunkTimeout))
+		if _, err := io.ReadFull(data, chunk); err != nil {
+			s.Reset()
+			return "", fmt.Errorf("transfer interrupted: %w", err)
+		}
+		if digest := sha256.Sum256(chunk); !bytes.Equal(digest[:], resp.ChunkHashes[i]) {
+			s.Reset()
+			return "", fmt.Errorf("chunk %d failed verification", i)
+		}
+		if _, err := partial.WriteAt(chunk, int64(i)*fileChunkSize); err != nil {
+			s.Reset()
+			return "", err
+		}
+		t.add(int64(len(chunk)))
+	}
+
+	if err := partial.Truncate(resp.Size); err != nil {
+		return "", err
+	}
+	if err := partial.Close(); err != nil {
+		return "", err
+	}
+	return saveDownload(partialPath, dir, pending.offer.Name)
+}
+
+// missingChunks returns the chunks of a partial download that are absent
+// or do not match their hash.
+func missingChunks(partial *os.File, chunkHashes [][]byte, size int64) ([]int, error) {
+	missing := []int{}
+	buf := make([]byte, fileChunkSize)
+	for i, want := range chunkHashes {
+		chunk := buf[:chunkLength(size, i)]
+		if _, err := partial.ReadAt(chunk, int64(i)*fileChunkSize); err != nil {
+			if err != io.EOF {
+				return nil, err
+			}
+			missing = append(missing, i)
+			continue
+		}
+		if digest := sha256.Sum256(chunk); !bytes.Equal(digest[:], want) {
+			missing = append(missing, i)
+		}
+	}
+	return missing, nil
+}
+
+// handleFileRequest streams the requested chunks of an offered file to a
+// peer allowed to download it.
+func (n *Node) handleFileRequest(s network.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(fileHeaderTimeout))
+
+	decoder := json.NewDecoder(io.LimitReader(s, maxFileHeaderSize))
+	var req fileRequest
+	if err := decoder.Decode(&req); err != nil {
+		s.Reset()
+		return
+	}
+
+	shared, err := n.sharedFor(req.OfferID, s.Conn().RemotePeer())
+	if err != nil {
+		json.NewEncoder(s).Encode(fileResponse{Error: err.Error()})
+		return
+	}
+
+	// Local errors name our paths, so the peer only learns that it failed
+	file, err := os.Open(shared.path)
+	if err != nil {
+		logrus.WithError(err).Warnf("Failed to open offered file %s", shared.offer.Name)
+		json.NewEncoder(s).Encode(fileResponse{Error: "file is no longer available"})
+		return
+	}
+	defer file.Close()
+
+	resp := fileResponse{Size: shared.offer.Size, ChunkSize: fileChunkSize, ChunkHashes: shared.chunkHashes}
+	if err := json.NewEncoder(s).Encode(resp); err != nil {
+		s.Reset()
+		return
+	}
+
+	var chunks chunkRequest
+	if err := decoder.Decode(&chunks); err != nil {
+		s.Reset()
+		return
+	}
+	for _, i := range chunks.Chunks {
+		if i < 0 || i >= len(shared.chunkHashes) {
+			s.Reset()
+			return
+		}
+	}
+
+	// Track the upload until it completes, fails or is cancelled
+	t, ctx := n.Transfers.start(n.Context, shared.offer.Name, s.Conn().RemotePeer(), TransferUpload, shared.offer.Size)
+	defer n.Transfers.finish(t)
+	defer resetOnCancel(ctx, s)()
+	t.resume(shared.offer.Size - chunksLength(shared.offer.Size, chunks.Chunks))
+
+	buf := make([]byte, fileChunkSize)
+	for _, i := range chunks.Chunks {
+		chunk := buf[:chunkLength(shared.offer.Size, i)]
+		if _, err := file.ReadAt(chunk, int64(i)*fileChunkSize); err != nil && err != io.EOF {
+			logrus.WithError(err).Warnf("Failed to read %s", shared.offer.Name)
+			s.Reset()
+			return
+		}
+
+		// Never send content that no longer matches the offer
+		if digest := sha256.Sum256(chunk); !bytes.Equal(digest[:], shared.chunkHashes[i]) {
+			logrus.Warnf("Stopped sending %s, the file changed since it was offered", shared.offer.Name)
+			s.Reset()
+			return
+		}
+
+		s.SetWriteDeadline(time.Now().Add(fileChunkTimeout))
+		if _, err := s.Write(chunk); err != nil {
+			logrus.WithError(err).Debugf("Failed to send %s", shared.offer.Name)
+			s.Reset()
+			return
+		}
+		t.add(int64(len(chunk)))
+	}
+}
+
+// sharedFor returns an offered file if the peer may download it.
+func (n *Node) sharedFor(offerID string, p peer.ID) (*sharedFile, error) {
+	n.filesMutex.Lock()
+	defer n.filesMutex.Unlock()
+
+	// Forget offers that can no longer be downloaded
+	for id, shared := range n.shared {
+		if time.Now().After(shared.expires) {
+			delete(n.shared, id)
+		}
+	}
+
+	shared, ok := n.shared[offerID]
+	switch {
+	case !ok:
+		return nil, errors.New("offer expired or unknown")
+	case shared.recipient != "" && shared.recipient != p:
+		return nil, errors.New("offer is for another peer")
+	case shared.room != nil && !shared.room.hasPeer(p):
+		return nil, errors.New("offer is for members of the room")
+	}
+	return shared, nil
+}
+
+// DefaultDownloadDir returns the default directory for downloaded files.
+func DefaultDownloadDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(DefaultDataDir(), "downloads")
+	}
+	return filepath.Join(home, "Downloads", "peerchat")
+}
+
+// sanitizeFileName turns a name chosen by the sender into a safe name
+// for a single file in the download directory.
+func sanitizeFileName(name string) string {
+	// Only the last element of a path is kept, whatever its separators
+	name = name[strings.LastIndexAny(name, `/\`)+1:]
+
+	// Drop control and invisible formatting characters, such as the
+	// right-to-left override used to disguise file extensions, and
+	// replace characters that are not allowed in file names
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r) || unicode.Is(unicode.Cf, r):
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+
+	// No hidden files, no dot-only names and no trailing dots or spaces
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	name = strings.TrimRight(name, ". ")
+
+	// Shorten long names while keeping the extension
+	if len(name) > maxFileNameLength {
+		ext := filepath.Ext(name)
+		if len(ext) > maxFileNameLength/4 {
+			ext = ""
+		}
+		name = strings.ToValidUTF8(name[:maxFileNameLength-len(ext)], "") + ext
+	}
+
+	if name == "" {
+		return "download"
+	}
+	return name
+}
+
+// reserveDownloadPath creates an empty file for a download and returns
+// its path. A counter is added to the name while a file of that name
+// exists, as in "report (1).pdf".
+func reserveDownloadPath(dir, name string) (string, error) {
+	name = sanitizeFileName(name)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	for i := 0; i < 1000; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+
+		path := filepath.Join(dir, candidate)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("unable to create file: %w", err)
+		}
+		file.Close()
+		return path, nil
+	}
+	return "", fmt.Errorf("too many files named %s", name)
+}
+
+// downloadDir creates the download directory if needed, removes the
+// incomplete downloads left there for too long and returns it.
+func (n *Node) downloadDir() (string, error) {
+	dir := n.downloads.Dir
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("unable to create download directory: %w", err)
+	}
+	cleanPartialDownloads(dir)
+	return dir, nil
+}
+
+// trackDownload runs a download listed as a transfer until it completes,
+// fails or is cancelled, and returns the path the file was saved to. A
+// cancelled download returns errTransferCancelled.
+func (n *Node) trackDownload(ctx context.Context, name string, from peer.ID, size int64, download func(ctx context.Context, t *transfer) (string, error)) (string, error) {
+	t, ctx := n.Transfers.start(ctx, name, from, TransferDownload, size)
+	defer n.Transfers.finish(t)
+
+	path, err := download(ctx, t)
+	if err != nil && ctx.Err() != nil {
+		return "", errTransferCancelled
+	}
+	return path, err
+}
+
+// saveDownload moves a complete partial file into the download directory
+// under the sanitised name it was shared with, and returns its path. An
+// existing file is never overwritten.
+func saveDownload(partialPath, dir, name string) (string, error) {
+	path, err := reserveDownloadPath(dir, name)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(partialPath, path); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// openDownload opens a saved download with the default application if
+// enabled. Files from peers are never launched otherwise.
+func (n *Node) openDownload(path string) {
+	if !n.downloads.AutoOpen {
+		return
+	}
+	if err := openFile(path); err != nil {
+		logrus.WithError(err).Error("Failed to open file")
+	}
+}
+
+// cleanPartialDownloads removes incomplete downloads that were not
+// resumed in time.
+func cleanPartialDownloads(dir string) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".peerchat-") && strings.HasSuffix(name, ".part") &&
+			time.Since(entry.ModTime()) > partialDownloadLifetime {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+}
+
+// chunkCount returns the number of chunks of a file.
+func chunkCount(size int64) int64 {
+	return (size + fileChunkSize - 1) / fileChunkSize
+}
+
+// chunkLength returns the length of a chunk, the last one being shorter.
+func chunkLength(size int64, i int) int64 {
+	return minSize(size-int64(i)*fileChunkSize, fileChunkSize)
+}
+
+// chunksLength returns the total length of the given chunks of a file.
+func chunksLength(size int64, chunks []int) int64 {
+	var total int64
+	for _, i := range chunks {
+		total += chunkLength(size, i)
+	}
+	return total
+}
+
+// minSize returns the smaller of two sizes.
+func minSize(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// formatSize returns a byte count in human-readable units.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,313 @@
+package src
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Longest history line accepted when reading a log file
+const maxHistoryLine = 1024 * 1024
+
+// historyRecord is a single message stored in a room's history log.
+type historyRecord struct {
+	ID       string    `json:"id,omitempty"`
+	Time     time.Time `json:"time"`
+	Self     bool      `json:"self"`
+	Verified bool      `json:"verified"`
+	// Edited and Retracted are set once the sender changed the message
+	Edited    bool    `json:"edited,omitempty"`
+	Retracted bool    `json:"retracted,omitempty"`
+	Message   chatMsg `json:"message"`
+	// Envelope is the signed PubSub message, kept so peers can verify it
+	Envelope []byte `json:"envelope,omitempty"`
+}
+
+// HistoryOptions controls how much history is replayed and kept.
+type HistoryOptions struct {
+	// Replay is the number of messages shown when joining a room
+	Replay int
+	// MaxAge drops records older than this when a room is joined, 0 keeps all
+	MaxAge time.Duration
+	// MaxSize caps a room's log file in bytes when a room is joined, 0 is unlimited
+	MaxSize int64
+}
+
+// HistoryStore keeps an append-only JSON lines log per room under a
+// data directory.
+type HistoryStore struct {
+	dir     string
+	options HistoryOptions
+	mutex   sync.Mutex
+}
+
+// OpenHistoryStore creates the history directory if needed and returns
+// a store writing into it.
+func OpenHistoryStore(dir string, options HistoryOptions) (*HistoryStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create history directory: %w", err)
+	}
+	return &HistoryStore{dir: dir, options: options}, nil
+}
+
+// DefaultDataDir returns the default directory for peerchat state.
+func DefaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".peerchat"
+	}
+	return filepath.Join(home, ".peerchat")
+}
+
+// roomPath returns the log file of a room, escaping the room name so
+// it is always a single path element.
+func (h *HistoryStore) roomPath(room string) string {
+	return filepath.Join(h.dir, url.PathEscape(room)+".log")
+}
+
+// Append writes a record to the end of a room's log.
+func (h *HistoryStore) Append(room string, record historyRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	file, err := os.OpenFile(h.roomPath(room), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open history: %w", err)
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// Last returns up to n of the most recent records of a room, oldest first.
+func (h *HistoryStore) Last(room string, n int) ([]historyRecord, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	records, err := h.readAll(room)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > n {
+		records = records[len(records)-n:]
+	}
+	return records, nil
+}
+
+// Replay returns the records shown when joining a room.
+func (h *HistoryStore) Replay(room string) ([]historyRecord, error) {
+	return h.Last(room, h.options.Replay)
+}
+
+// Since returns up to limit records of a room received after the record
+// with the given ID or, if that ID is unknown, after the given time.
+func (h *HistoryStore) Since(room string, since time.Time, afterID string, limit int) ([]historyRecord, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	records, err := h.readAll(room)
+	if err != nil {
+		return nil, err
+	}
+
+	// Records are in arrival order, so everything stored after a known
+	// message is newer than it
+	found := false
+	if afterID != "" {
+		for i, record := range records {
+			if record.ID == afterID {
+				records = records[i+1:]
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		var newer []historyRecord
+		for _, record := range records {
+			if record.Time.After(since) {
+				newer = append(newer, record)
+			}
+		}
+		records = newer
+	}
+
+	if len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	return records, nil
+}
+
+// Prune applies the configured age and size limits to a room's log.
+func (h *HistoryStore) Prune(room string) error {
+	if h.options.MaxAge <= 0 && h.options.MaxSize <= 0 {
+		return nil
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	records, err := h.readAll(room)
+	if err != nil || len(records) == 0 {
+		return err
+	}
+
+	// Drop records older than the maximum age
+	if h.options.MaxAge > 0 {
+		cutoff := time.Now().Add(-h.options.MaxAge)
+		for len(records) > 0 && records[0].Time.Before(cutoff) {
+			records = records[1:]
+		}
+	}
+
+	// Encode the remaining records and drop the oldest until they fit
+	lines := make([][]byte, 0, len(records))
+	var size int64
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, append(data, '\n'))
+		size += int64(len(data) + 1)
+	}
+	if h.options.MaxSize > 0 {
+		for len(lines) > 0 && size > h.options.MaxSize {
+			size -= int64(len(lines[0]))
+			lines = lines[1:]
+		}
+	}
+	return h.rewrite(room, lines)
+}
+
+// Amend updates the stored record of the message with the given ID. Only
+// the first message with the ID is updated, later ones reusing its ID and
+// changes are left alone. The update function reports whether it changed
+// the record.
+func (h *HistoryStore) Amend(room, id string, update func(record *historyRecord) bool) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	records, err := h.readAll(room)
+	if err != nil || len(records) == 0 {
+		return err
+	}
+
+	changed := false
+	for i := range records {
+		// Messages of older clients are identified by their envelope
+		msgID := records[i].Message.ID
+		if msgID == "" {
+			msgID = records[i].ID
+		}
+		if msgID == id && !isChange(records[i].Message) {
+			changed = update(&records[i])
+			break
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return h.writeRecords(room, records)
+}
+
+// AmendChanges updates the stored edits, retractions and reactions of the
+// message with the given ID. The update function reports whether it
+// changed a record.
+func (h *HistoryStore) AmendChanges(room, id string, update func(record *historyRecord) bool) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	records, err := h.readAll(room)
+	if err != nil || len(records) == 0 {
+		return err
+	}
+
+	changed := false
+	for i := range records {
+		if isChange(records[i].Message) && records[i].Message.Target == id && update(&records[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return h.writeRecords(room, records)
+}
+
+// writeRecords replaces a room's log with the given records. The caller
+// must hold the store mutex.
+func (h *HistoryStore) writeRecords(room string, records []historyRecord) error {
+	lines := make([][]byte, 0, len(records))
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, append(data, '\n'))
+	}
+	return h.rewrite(room, lines)
+}
+
+// rewrite replaces a room's log with the given lines. The caller must
+// hold the store mutex.
+func (h *HistoryStore) rewrite(room string, lines [][]byte) error {
+	// Rewrite the log through a temporary file so a crash never truncates it
+	tmp, err := ioutil.TempFile(h.dir, "rewrite-*")
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if _, err := tmp.Write(line); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), h.roomPath(room))
+}
+
+// readAll reads every record of a room, skipping malformed lines.
+// The caller must hold the store mutex.
+func (h *HistoryStore) readAll(room string) ([]historyRecord, error) {
+	file, err := os.Open(h.roomPath(room))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open history: %w", err)
+	}
+	defer file.Close()
+
+	var records []historyRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxHistoryLine)
+	for scanner.Scan() {
+		var record historyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
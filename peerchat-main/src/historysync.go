@@ -0,0 +1,341 @@
+package src
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/sirupsen/logrus"
+)
+
+// Protocol used to ask room peers for messages sent before we joined
+const historyProtocol = "/peerchat/history/1.0.0"
+
+const (
+	// How long to wait after joining before asking peers for history
+	catchUpDelay = 5 * time.Second
+	// How many room peers are asked for history
+	catchUpPeers = 3
+	// Most records returned for a single history request
+	maxHistoryResponse = 200
+	// Deadline for a complete history request and response
+	historyTimeout = 30 * time.Second
+	// Largest history response accepted from a peer
+	maxHistoryResponseSize = 8 * 1024 * 1024
+)
+
+// historyRequest asks a peer for the messages of a room sent after the
+// message with ID After or, if the peer does not know it, after Since.
+type historyRequest struct {
+	Room  string    `json:"room"`
+	Since time.Time `json:"since"`
+	After string    `json:"after,omitempty"`
+	Limit int       `json:"limit"`
+}
+
+// historyItem is a single signed message returned by a peer.
+type historyItem struct {
+	Time     time.Time `json:"time"`
+	Envelope []byte    `json:"envelope"`
+}
+
+// historyResponse carries the messages returned for a historyRequest.
+type historyResponse struct {
+	Items []historyItem `json:"items"`
+}
+
+// registerRoom makes a joined room's history available to its peers.
+func (n *Node) registerRoom(c *ChatRoom) {
+	n.roomsMutex.Lock()
+	defer n.roomsMutex.Unlock()
+	n.rooms[c.historyKey] = c
+}
+
+// unregisterRoom stops serving the history of a room that was left.
+func (n *Node) unregisterRoom(c *ChatRoom) {
+	n.roomsMutex.Lock()
+	defer n.roomsMutex.Unlock()
+	if n.rooms[c.historyKey] == c {
+		delete(n.rooms, c.historyKey)
+	}
+}
+
+// joinedRoom returns the joined room with the given history key, or nil.
+func (n *Node) joinedRoom(key string) *ChatRoom {
+	n.roomsMutex.Lock()
+	defer n.roomsMutex.Unlock()
+	return n.rooms[key]
+}
+
+// handleHistoryRequest serves stored history of a joined room to a peer
+// that is subscribed to the same room.
+func (n *Node) handleHistoryRequest(s network.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(historyTimeout))
+
+	var req historyRequest
+	if err := json.NewDecoder(io.LimitReader(s, 4096)).Decode(&req); err != nil {
+		s.Reset()
+		return
+	}
+
+	var resp historyResponse
+	room := n.joinedRoom(req.Room)
+	if room != nil && n.History != nil && room.hasPeer(s.Conn().RemotePeer()) {
+		limit := req.Limit
+		if limit <= 0 || limit > maxHistoryResponse {
+			limit = maxHistoryResponse
+		}
+
+		records, err := n.History.Since(req.Room, req.Since, req.After, limit)
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to read history for peer")
+		}
+		for _, record := range records {
+			if len(record.Envelope) > 0 {
+				resp.Items = append(resp.Items, historyItem{Time: record.Time, Envelope: record.Envelope})
+			}
+		}
+	}
+
+	if err := json.NewEncoder(s).Encode(resp); err != nil {
+		s.Reset()
+	}
+}
+
+// requestHistory asks a single peer for room history.
+func (n *Node) requestHistory(ctx context.Context, p peer.ID, req historyRequest) ([]historyItem, error) {
+	ctx, cancel := context.WithTimeout(ctx, historyTimeout)
+	defer cancel()
+
+	s, err := n.Host.NewStream(ctx, p, historyProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(historyTimeout))
+
+	if err := json.NewEncoder(s).Encode(req); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	if err := s.CloseWrite(); err != nil {
+		s.Reset()
+		return nil, err
+	}
+
+	var resp historyResponse
+	if err := json.NewDecoder(io.LimitReader(s, maxHistoryResponseSize)).Decode(&resp); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	return resp.Items, nil
+}
+
+// hasPeer reports whether a peer is subscribed to the room.
+func (c *ChatRoom) hasPeer(p peer.ID) bool {
+	for _, member := range c.topic.ListPeers() {
+		if member == p {
+			return true
+		}
+	}
+	return false
+}
+
+// markSeen records a message ID and reports whether it was new.
+func (c *ChatRoom) markSeen(id string) bool {
+	if id == "" {
+		return true
+	}
+
+	c.seenMutex.Lock()
+	defer c.seenMutex.Unlock()
+	if c.seen[id] {
+		return false
+	}
+	c.seen[id] = true
+	return true
+}
+
+// catchUpHistory asks a few room peers for the messages sent since the
+// last stored one, then stores and delivers the verified new messages.
+func (c *ChatRoom) catchUpHistory() {
+	// Wait for the topic mesh to form so there are peers to ask
+	select {
+	case <-time.After(catchUpDelay):
+	case <-c.roomCtx.Done():
+		return
+	}
+
+	req := historyRequest{Room: c.historyKey, Limit: maxHistoryResponse}
+	if len(c.Backlog) > 0 {
+		last := c.Backlog[len(c.Backlog)-1]
+		req.Since = last.Time
+		req.After = last.ID
+	}
+
+	peers := c.topic.ListPeers()
+	if len(peers) > catchUpPeers {
+		peers = peers[:catchUpPeers]
+	}
+
+	var merged []historyRecord
+	for _, p := range peers {
+		items, err := c.NodeHost.requestHistory(c.roomCtx, p, req)
+		if err != nil {
+			logrus.WithError(err).Debugf("Failed to fetch history from %s", p)
+			continue
+		}
+
+		for _, item := range items {
+			record, err := c.decodeHistoryItem(item)
+			if err != nil {
+				logrus.WithError(err).Debugf("Dropped history message from %s", p)
+				continue
+			}
+			if c.markSeen(record.ID) {
+				c.rememberSender(record.Message)
+				c.observeClock(&record.Message)
+				merged = append(merged, record)
+			}
+		}
+	}
+	if len(merged) == 0 {
+		return
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return messageBefore(merged[i].Message, merged[j].Message)
+	})
+	kept, shown := c.applyHistoryChanges(merged)
+
+	if c.NodeHost.History != nil {
+		for _, record := range kept {
+			if err := c.NodeHost.History.Append(c.historyKey, record); err != nil {
+				logrus.WithError(err).Warn("Failed to store message history")
+			}
+		}
+	}
+
+	if len(shown) == 0 {
+		return
+	}
+	select {
+	case c.CatchUpMessages <- shown:
+	case <-c.roomCtx.Done():
+	}
+}
+
+// decodeHistoryItem checks the signature and topic of a message returned
+// by a peer and binds its claimed sender to the signer.
+func (c *ChatRoom) decodeHistoryItem(item historyItem) (historyRecord, error) {
+	var envelope pb.Message
+	if err := envelope.Unmarshal(item.Envelope); err != nil {
+		return historyRecord{}, err
+	}
+	if err := verifyEnvelope(&envelope); err != nil {
+		return historyRecord{}, err
+	}
+
+	inRoom := false
+	for _, topic := range envelope.GetTopicIDs() {
+		if topic == c.topicName {
+			inRoom = true
+		}
+	}
+	if !inRoom {
+		return historyRecord{}, errors.New("message belongs to another room")
+	}
+
+	msg, err := c.decodeMessage(envelope.GetData())
+	if err != nil {
+		return historyRecord{}, err
+	}
+	if msg.MsgType != "" && msg.MsgType != "text" && !isChange(msg) {
+		return historyRecord{}, errors.New("only text messages and their changes are part of the history")
+	}
+
+	from, err := peer.IDFromBytes(envelope.GetFrom())
+	if err != nil {
+		return historyRecord{}, err
+	}
+	if !c.verifySender(from, &msg) {
+		return historyRecord{}, errors.New("sender does not match signer")
+	}
+
+	if msg.ID == "" {
+		msg.ID = envelopeID(&envelope)
+	}
+	msg.Self = from == c.hostID
+
+	return historyRecord{
+		ID:       envelopeID(&envelope),
+		Time:     item.Time,
+		Self:     from == c.hostID,
+		Verified: msg.Verified,
+		Message:  msg,
+		Envelope: item.Envelope,
+	}, nil
+}
+
+// envelopeID returns the PubSub message ID (sender and sequence number).
+func envelopeID(envelope *pb.Message) string {
+	return hex.EncodeToString(envelope.GetFrom()) + hex.EncodeToString(envelope.GetSeqno())
+}
+
+// verifyEnvelope checks the signature of a PubSub message the same way
+// the PubSub router does for live messages.
+func verifyEnvelope(envelope *pb.Message) error {
+	if len(envelope.Signature) == 0 {
+		return errors.New("message is not signed")
+	}
+
+	from, err := peer.IDFromBytes(envelope.GetFrom())
+	if err != nil {
+		return err
+	}
+
+	var publicKey crypto.PubKey
+	if envelope.Key == nil {
+		publicKey, err = from.ExtractPublicKey()
+	} else {
+		publicKey, err = crypto.UnmarshalPublicKey(envelope.Key)
+		if err == nil && !from.MatchesPublicKey(publicKey) {
+			err = errors.New("signing key does not match sender")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("unable to get signing key: %w", err)
+	}
+	if publicKey == nil {
+		return errors.New("unable to get signing key")
+	}
+
+	// The signature covers the message without its signature and key
+	unsigned := *envelope
+	unsigned.Signature = nil
+	unsigned.Key = nil
+	data, err := unsigned.Marshal()
+	if err != nil {
+		return err
+	}
+
+	valid, err := publicKey.Verify(append([]byte(pubsub.SignPrefix), data...), envelope.Signature)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errors.New("invalid message signature")
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package src
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Supported identity key types
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// Permissions applied to the keystore file and its directory
+const (
+	keystoreFileMode = 0600
+	keystoreDirMode  = 0700
+)
+
+// scrypt parameters used to derive the keystore encryption key
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+// keystoreFile is the on-disk representation of a node identity.
+type keystoreFile struct {
+	KeyType   string `json:"key_type"`
+	Encrypted bool   `json:"encrypted"`
+	Salt      []byte `json:"salt,omitempty"`
+	Nonce     []byte `json:"nonce,omitempty"`
+	Key       []byte `json:"key"`
+}
+
+// LoadIdentity reads the private key stored at path, creating a new key of
+// the given type on first run. If passphrase is non-empty the key is stored
+// encrypted and must be unlocked with the same passphrase on later runs.
+func LoadIdentity(path, keyType, passphrase string) (crypto.PrivKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return createIdentity(path, keyType, passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read identity file: %w", err)
+	}
+
+	if err := checkKeystorePermissions(path); err != nil {
+		return nil, err
+	}
+
+	var stored keystoreFile
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("malformed identity file %s: %w", path, err)
+	}
+
+	keyBytes := stored.Key
+	if stored.Encrypted {
+		if passphrase == "" {
+			return nil, fmt.Errorf("identity file %s is encrypted but no passphrase was given", path)
+		}
+		keyBytes, err = decryptKey(stored, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	privateKey, err := crypto.UnmarshalPrivateKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode identity key: %w", err)
+	}
+	return privateKey, nil
+}
+
+// createIdentity generates a new private key and writes it to path.
+func createIdentity(path, keyType, passphrase string) (crypto.PrivKey, error) {
+	var privateKey crypto.PrivKey
+	var err error
+
+	switch strings.ToLower(keyType) {
+	case KeyTypeRSA:
+		privateKey, _, err = crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
+	case KeyTypeEd25519, "":
+		keyType = KeyTypeEd25519
+		privateKey, _, err = crypto.GenerateKeyPairWithReader(crypto.Ed25519, -1, rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", keyType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate private key: %w", err)
+	}
+
+	keyBytes, err := crypto.MarshalPrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode private key: %w", err)
+	}
+
+	stored := keystoreFile{KeyType: strings.ToLower(keyType), Key: keyBytes}
+	if passphrase != "" {
+		if stored, err = encryptKey(stored, passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), keystoreDirMode); err != nil {
+		return nil, fmt.Errorf("unable to create identity directory: %w", err)
+	}
+	// Write the key to a temporary file first, so a failed write never
+	// leaves a partial identity behind. Temporary files are created 0600.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".identity-*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create identity file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("unable to write identity file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("unable to write identity file: %w", err)
+	}
+
+	// Linking fails if the file exists, so two instances never race to
+	// create the same identity
+	if err := os.Link(tmp.Name(), path); err != nil {
+		return nil, fmt.Errorf("unable to create identity file: %w", err)
+	}
+	return privateKey, nil
+}
+
+// encryptKey seals the key bytes with AES-GCM using a passphrase-derived key.
+func encryptKey(stored keystoreFile, passphrase string) (keystoreFile, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return stored, err
+	}
+
+	aead, err := keystoreCipher(passphrase, salt)
+	if err != nil {
+		return stored, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return stored, err
+	}
+
+	stored.Encrypted = true
+	stored.Salt = salt
+	stored.Nonce = nonce
+	stored.Key = aead.Seal(nil, nonce, stored.Key, []byte(stored.KeyType))
+	return stored, nil
+}
+
+// decryptKey opens the key bytes of an encrypted keystore.
+func decryptKey(stored keystoreFile, passphrase string) ([]byte, error) {
+	aead, err := keystoreCipher(passphrase, stored.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(stored.Nonce) != aead.NonceSize() {
+		return nil, errors.New("malformed identity file nonce")
+	}
+
+	keyBytes, err := aead.Open(nil, stored.Nonce, stored.Key, []byte(stored.KeyType))
+	if err != nil {
+		return nil, errors.New("unable to decrypt identity file, wrong passphrase?")
+	}
+	return keyBytes, nil
+}
+
+// keystoreCipher derives an AES-GCM cipher from a passphrase and salt.
+func keystoreCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	derived, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// checkKeystorePermissions refuses identity files readable by other users.
+func checkKeystorePermissions(path string) error {
+	// Windows does not expose unix permission bits
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("identity file %s has permissions %#o, expected %#o", path, info.Mode().Perm(), keystoreFileMode)
+	}
+	return nil
+}
+
+// DefaultIdentityPath returns the default location of the identity file.
+func DefaultIdentityPath() string {
+	return filepath.Join(DefaultDataDir(), "identity.key")
+}
@@ -0,0 +1,175 @@
+package src
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/sirupsen/logrus"
+	"rsc.io/qr"
+)
+
+const (
+	// Prefix of every invite token, also used as the format version
+	invitePrefix = "peerchat1:"
+	// Domain separation for invite signatures
+	inviteSignPrefix = "peerchat-invite:"
+	// How long an invite token can be used
+	inviteLifetime = 24 * time.Hour
+	// Deadline for connecting to the inviter
+	inviteDialTimeout = 30 * time.Second
+)
+
+// invitePayload is the signed content of an invite token. Field names
+// are kept short so tokens stay easy to copy and fit in a QR code.
+type invitePayload struct {
+	Room    string   `json:"r"`
+	Key     []byte   `json:"k,omitempty"`
+	Inviter string   `json:"i"`
+	Addrs   []string `json:"a"`
+	Expires int64    `json:"e"`
+}
+
+// Invite is a verified invitation to a chat room.
+type Invite struct {
+	Room    string
+	Key     []byte
+	Inviter peer.AddrInfo
+	Expires time.Time
+}
+
+// CreateInvite returns a signed token inviting others to this room. It
+// carries the room key of a private room and the addresses we can be
+// reached on, so the invitee can connect without the public DHT.
+func (c *ChatRoom) CreateInvite() (string, error) {
+	node := c.NodeHost
+	privateKey := node.Host.Peerstore().PrivKey(node.Host.ID())
+	if privateKey == nil {
+		return "", errors.New("node private key is unavailable")
+	}
+
+	// Loopback addresses are useless to anyone on another machine
+	var addrs []string
+	for _, addr := range node.Host.Addrs() {
+		if !manet.IsIPLoopback(addr) {
+			addrs = append(addrs, addr.String())
+		}
+	}
+
+	invite, err := signPayload(privateKey, inviteSignPrefix, invitePayload{
+		Room:    c.RoomName,
+		Key:     c.roomKey,
+		Inviter: node.Host.ID().Pretty(),
+		Addrs:   addrs,
+		Expires: time.Now().Add(inviteLifetime).Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to sign invite: %w", err)
+	}
+
+	data, err := json.Marshal(invite)
+	if err != nil {
+		return "", err
+	}
+	return invitePrefix + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// ParseInvite decodes an invite token and verifies its signature and expiry.
+func ParseInvite(token string) (*Invite, error) {
+	token = strings.TrimSpace(token)
+	if !strings.HasPrefix(token, invitePrefix) {
+		return nil, errors.New("not a peerchat invite token")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, invitePrefix))
+	if err != nil {
+		return nil, fmt.Errorf("malformed invite token: %w", err)
+	}
+	var invite signedPayload
+	if err := json.Unmarshal(data, &invite); err != nil {
+		return nil, fmt.Errorf("malformed invite token: %w", err)
+	}
+	var payload invitePayload
+	if err := json.Unmarshal(invite.Payload, &payload); err != nil {
+		return nil, fmt.Errorf("malformed invite token: %w", err)
+	}
+
+	inviter, err := invite.verify(inviteSignPrefix, payload.Inviter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invite: %w", err)
+	}
+
+	expires := time.Unix(payload.Expires, 0)
+	if time.Now().After(expires) {
+		return nil, fmt.Errorf("invite expired at %s", expires.Format(time.RFC1123))
+	}
+	if payload.Key != nil && len(payload.Key) != RoomKeySize {
+		return nil, errors.New("invalid room key in invite")
+	}
+
+	info := peer.AddrInfo{ID: inviter}
+	for _, addr := range payload.Addrs {
+		maddr, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid inviter address %q: %w", addr, err)
+		}
+		info.Addrs = append(info.Addrs, maddr)
+	}
+
+	return &Invite{Room: payload.Room, Key: payload.Key, Inviter: info, Expires: expires}, nil
+}
+
+// AcceptInvite connects directly to the inviter and joins the invited
+// room. A failed connection is logged rather than returned, since the
+// room may still be reachable through other peers.
+func (n *Node) AcceptInvite(invite *Invite, username string) (*ChatRoom, error) {
+	ctx, cancel := context.WithTimeout(n.Context, inviteDialTimeout)
+	defer cancel()
+
+	if err := n.Host.Connect(ctx, invite.Inviter); err != nil {
+		logrus.WithError(err).Warnf("Failed to connect to inviter %s", invite.Inviter.ID)
+	}
+
+	if invite.Key != nil {
+		return JoinPrivateRoom(n, username, invite.Room, invite.Key)
+	}
+	return JoinRoom(n, username, invite.Room)
+}
+
+// RenderQR renders text as a QR code made of unicode half blocks, two
+// code rows per line of text, drawn light on dark with a quiet zone.
+func RenderQR(text string) (string, error) {
+	code, err := qr.Encode(text, qr.L)
+	if err != nil {
+		return "", err
+	}
+
+	// The QR specification requires a quiet zone of four modules
+	const quiet = 4
+	var b strings.Builder
+	for y := -quiet; y < code.Size+quiet; y += 2 {
+		for x := -quiet; x < code.Size+quiet; x++ {
+			// Black reports false outside the code, which is the quiet zone
+			top, bottom := !code.Black(x, y), !code.Black(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteRune('█')
+			case top:
+				b.WriteRune('▀')
+			case bottom:
+				b.WriteRune('▄')
+			default:
+				b.WriteRune(' ')
+			}
+		}
+		b.WriteRune('\n')
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,38 @@
+package src
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	mdns "github.com/libp2p/go-libp2p/p2p/discovery"
+)
+
+// How often the local network is queried for other peerchat nodes
+const mdnsInterval = 10 * time.Second
+
+// mdnsNotifee forwards peers found on the local network to a channel.
+type mdnsNotifee struct {
+	peers chan peer.AddrInfo
+}
+
+// HandlePeerFound is called by the mDNS service for every discovered peer.
+func (m *mdnsNotifee) HandlePeerFound(info peer.AddrInfo) {
+	m.peers <- info
+}
+
+// StartMDNS advertises the node on the local network and connects
+// to other peerchat nodes found there, without relying on the DHT.
+func (n *Node) StartMDNS() error {
+	service, err := mdns.NewMdnsService(n.Context, n.Host, mdnsInterval, p2pServiceName)
+	if err != nil {
+		return fmt.Errorf("unable to start mDNS discovery: %w", err)
+	}
+
+	notifee := &mdnsNotifee{peers: make(chan peer.AddrInfo)}
+	service.RegisterNotifee(notifee)
+	n.mdnsService = service
+
+	go connectToDiscoveredPeers(n.Context, n.Host, notifee.peers)
+	return nil
+}
@@ -0,0 +1,338 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+	"github.com/sirupsen/logrus"
+)
+
+// DHT namespace of peerchat records, checked by nameValidator
+const nameNamespace = "peerchat"
+
+const (
+	// Domain separation for name record signatures
+	nameSignPrefix = "peerchat-name:"
+	// How long a name registration lasts without renewal
+	nameLifetime = 24 * time.Hour
+	// How often a claimed name is renewed
+	nameRenewInterval = nameLifetime / 2
+	// How far a record may expire beyond nameLifetime, for clock skew
+	nameClockSkew = 5 * time.Minute
+	// How long a looked up name owner is cached
+	nameCacheTTL = 10 * time.Minute
+	// Deadline for a single registry lookup or update
+	nameTimeout = 30 * time.Second
+)
+
+// ErrNameTaken is returned when claiming a name registered to another peer.
+var ErrNameTaken = errors.New("name is registered to another peer")
+
+// nameClaim is the signed content of a name record. Claimed is chosen by
+// the claimer, so it is informational only and never decides ownership.
+type nameClaim struct {
+	Name    string `json:"name"`
+	Owner   string `json:"owner"`
+	Claimed int64  `json:"claimed"`
+	Expires int64  `json:"expires"`
+}
+
+// cachedName is a name owner looked up in the registry.
+type cachedName struct {
+	owner   peer.ID
+	checked time.Time
+}
+
+// nameKey returns the DHT key of a name record.
+func nameKey(name string) string {
+	return "/" + nameNamespace + "/name/" + name
+}
+
+// nameValidator checks the name records stored under the peerchat
+// namespace of the DHT. Claim times cannot be trusted, so every node
+// remembers the first owner it saw for a name and keeps preferring that
+// owner's records over those of anyone else until they expire.
+type nameValidator struct {
+	owners map[string]nameClaim
+	mutex  sync.Mutex
+}
+
+// newNameValidator returns a validator that has not seen any name yet.
+func newNameValidator() *nameValidator {
+	return &nameValidator{owners: make(map[string]nameClaim)}
+}
+
+// Validate accepts signed, unexpired records stored under their own name,
+// and remembers the owner of a name the first time one is seen.
+func (v *nameValidator) Validate(key string, value []byte) error {
+	claim, err := checkNameRecord(key, value)
+	if err != nil {
+		return err
+	}
+	v.remember(key, claim)
+	return nil
+}
+
+// Select prefers the records of the owner this node saw first. Among
+// records of the same owner the one expiring last wins, so renewals
+// replace older records. An existing, unexpired registration therefore
+// always beats a newer owner's record, whatever claim time it states.
+func (v *nameValidator) Select(key string, values [][]byte) (int, error) {
+	v.mutex.Lock()
+	known, hasKnown := v.owners[key]
+	v.mutex.Unlock()
+	if hasKnown && time.Now().After(time.Unix(known.Expires, 0)) {
+		hasKnown = false
+	}
+
+	// Settle on the known owner if it has a record here, otherwise on
+	// the owner of the first valid record
+	claims := make([]*nameClaim, len(values))
+	owner := ""
+	for i, value := range values {
+		claim, err := checkNameRecord(key, value)
+		if err != nil {
+			continue
+		}
+		claims[i] = &claim
+		if owner == "" || (hasKnown && claim.Owner == known.Owner) {
+			owner = claim.Owner
+		}
+	}
+
+	best := -1
+	for i, claim := range claims {
+		if claim == nil || claim.Owner != owner {
+			continue
+		}
+		if best < 0 || claim.Expires > claims[best].Expires {
+			best = i
+		}
+	}
+	if best < 0 {
+		return 0, errors.New("no valid name record")
+	}
+	v.remember(key, *claims[best])
+	return best, nil
+}
+
+// remember records the owner of a name unless another owner's
+// registration is still current. Renewals extend the registration.
+func (v *nameValidator) remember(key string, claim nameClaim) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	// Forget registrations that expired
+	now := time.Now()
+	for k, known := range v.owners {
+		if now.After(time.Unix(known.Expires, 0)) {
+			delete(v.owners, k)
+		}
+	}
+
+	known, ok := v.owners[key]
+	if !ok || (known.Owner == claim.Owner && claim.Expires > known.Expires) {
+		v.owners[key] = claim
+	}
+}
+
+// checkNameRecord decodes a name record, checking its signature, its key
+// and that it has not expired. Records expiring later than a registration
+// can last are refused, or their owner would keep the name for good.
+func checkNameRecord(key string, value []byte) (nameClaim, error) {
+	claim, err := openNameRecord(value)
+	if err != nil {
+		return nameClaim{}, err
+	}
+	if key != nameKey(claim.Name) {
+		return nameClaim{}, errors.New("name record stored under another key")
+	}
+	expires := time.Unix(claim.Expires, 0)
+	if time.Now().After(expires) {
+		return nameClaim{}, errors.New("name record expired")
+	}
+	if expires.After(time.Now().Add(nameLifetime + nameClockSkew)) {
+		return nameClaim{}, errors.New("name record expires too late")
+	}
+	return claim, nil
+}
+
+// openNameRecord decodes a name record and verifies that its owner
+// signed it.
+func openNameRecord(value []byte) (nameClaim, error) {
+	var record signedPayload
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nameClaim{}, fmt.Errorf("malformed name record: %w", err)
+	}
+	var claim nameClaim
+	if err := json.Unmarshal(record.Payload, &claim); err != nil {
+		return nameClaim{}, fmt.Errorf("malformed name record: %w", err)
+	}
+
+	if _, err := record.verify(nameSignPrefix, claim.Owner); err != nil {
+		return nameClaim{}, fmt.Errorf("invalid name record: %w", err)
+	}
+	return claim, nil
+}
+
+// ClaimName registers a username for this node in the DHT and keeps
+// renewing it until another name is claimed or the node shuts down.
+// It returns ErrNameTaken if another peer registered the name first.
+func (n *Node) ClaimName(name string) error {
+	ctx, cancel := context.WithTimeout(n.Context, nameTimeout)
+	defer cancel()
+
+	// Keep the original claim time when renewing our own registration
+	claimed := time.Now().Unix()
+	existing, err := n.lookupName(ctx, name)
+	switch {
+	case err == nil && existing.Owner != n.Host.ID().Pretty():
+		return fmt.Errorf("%w %s", ErrNameTaken, shortID(existing.Owner))
+	case err == nil:
+		claimed = existing.Claimed
+	case !errors.Is(err, routing.ErrNotFound):
+		logrus.WithError(err).Debugf("Failed to look up name '%s'", name)
+	}
+
+	if err := n.putName(ctx, name, claimed); err != nil {
+		return fmt.Errorf("unable to register name: %w", err)
+	}
+	n.cacheNameOwner(name, n.Host.ID())
+
+	// Renew the new name instead of the previous one
+	renewCtx, stopRenewal := context.WithCancel(n.Context)
+	n.namesMutex.Lock()
+	if n.stopRenewal != nil {
+		n.stopRenewal()
+	}
+	n.stopRenewal = stopRenewal
+	n.namesMutex.Unlock()
+
+	go n.renewName(renewCtx, name, claimed)
+	return nil
+}
+
+// renewName republishes a claimed name before its registration expires.
+func (n *Node) renewName(ctx context.Context, name string, claimed int64) {
+	ticker := time.NewTicker(nameRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			putCtx, cancel := context.WithTimeout(ctx, nameTimeout)
+			if err := n.putName(putCtx, name, claimed); err != nil {
+				logrus.WithError(err).Warnf("Failed to renew name '%s'", name)
+			}
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// putName signs and stores a name record for this node.
+func (n *Node) putName(ctx context.Context, name string, claimed int64) error {
+	privateKey := n.Host.Peerstore().PrivKey(n.Host.ID())
+	if privateKey == nil {
+		return errors.New("node private key is unavailable")
+	}
+
+	record, err := signPayload(privateKey, nameSignPrefix, nameClaim{
+		Name:    name,
+		Owner:   n.Host.ID().Pretty(),
+		Claimed: claimed,
+		Expires: time.Now().Add(nameLifetime).Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to sign name record: %w", err)
+	}
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return n.DHT.PutValue(ctx, nameKey(name), value)
+}
+
+// lookupName returns the current registration of a name.
+func (n *Node) lookupName(ctx context.Context, name string) (nameClaim, error) {
+	value, err := n.DHT.GetValue(ctx, nameKey(name))
+	if err != nil {
+		return nameClaim{}, err
+	}
+	return openNameRecord(value)
+}
+
+// nameOwner returns the registered owner of a name from the cache,
+// looking it up in the background when the entry is missing or stale.
+// It returns an empty ID while the owner is unknown.
+func (n *Node) nameOwner(name string) peer.ID {
+	n.namesMutex.Lock()
+	cached, ok := n.names[name]
+	stale := !ok || time.Since(cached.checked) > nameCacheTTL
+	if stale {
+		// Mark the entry as checked so only one lookup runs at a time
+		n.names[name] = cachedName{owner: cached.owner, checked: time.Now()}
+	}
+	n.namesMutex.Unlock()
+
+	if stale {
+		go func() {
+			ctx, cancel := context.WithTimeout(n.Context, nameTimeout)
+			defer cancel()
+
+			claim, err := n.lookupName(ctx, name)
+			if err != nil {
+				return
+			}
+			if owner, err := peer.Decode(claim.Owner); err == nil {
+				n.cacheNameOwner(name, owner)
+			}
+		}()
+	}
+	return cached.owner
+}
+
+// cacheNameOwner stores the registered owner of a name.
+func (n *Node) cacheNameOwner(name string, owner peer.ID) {
+	n.namesMutex.Lock()
+	defer n.namesMutex.Unlock()
+	n.names[name] = cachedName{owner: owner, checked: time.Now()}
+}
+
+// displayName returns the name a message is shown under. A name used by
+// several peers of the room, or registered to another peer, gets the
+// sender's short ID appended as name#shortid.
+func (c *ChatRoom) displayName(msg chatMsg) string {
+	id, err := peer.Decode(msg.SenderID)
+	if err != nil {
+		return msg.SenderName
+	}
+
+	ambiguous := false
+	c.sendersMutex.Lock()
+	for p, name := range c.senders {
+		if name == msg.SenderName && p != id {
+			ambiguous = true
+			break
+		}
+	}
+	c.sendersMutex.Unlock()
+
+	if !ambiguous {
+		owner := c.NodeHost.nameOwner(msg.SenderName)
+		ambiguous = owner != "" && owner != id
+	}
+
+	if ambiguous {
+		return fmt.Sprintf("%s#%s", msg.SenderName, shortID(msg.SenderID))
+	}
+	return msg.SenderName
+}
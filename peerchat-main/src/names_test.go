@@ -0,0 +1,82 @@
+package src
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// nameRecord returns a name record signed by a new key that expires
+// after the given duration.
+func nameRecord(t *testing.T, name string, expires time.Duration) []byte {
+	t.Helper()
+	privateKey, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := signPayload(privateKey, nameSignPrefix, nameClaim{
+		Name:    name,
+		Owner:   id.Pretty(),
+		Claimed: time.Now().Unix(),
+		Expires: time.Now().Add(expires).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestCheckNameRecordExpiry(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		expires time.Duration
+		valid   bool
+	}{
+		{"current", nameLifetime, true},
+		{"clock skew", nameLifetime + nameClockSkew/2, true},
+		{"expired", -time.Minute, false},
+		{"too late", nameLifetime + 2*nameClockSkew, false},
+		{"decades away", 30 * 365 * 24 * time.Hour, false},
+	} {
+		_, err := checkNameRecord(nameKey("alice"), nameRecord(t, "alice", tc.expires))
+		if valid := err == nil; valid != tc.valid {
+			t.Errorf("%s: valid %v, want %v (%v)", tc.name, valid, tc.valid, err)
+		}
+	}
+}
+
+func TestSelectIgnoresFarExpiry(t *testing.T) {
+	v := newNameValidator()
+	owner := nameRecord(t, "alice", nameLifetime)
+	squatter := nameRecord(t, "alice", 30*365*24*time.Hour)
+
+	if err := v.Validate(nameKey("alice"), squatter); err == nil {
+		t.Error("record expiring decades away was accepted")
+	}
+	best, err := v.Select(nameKey("alice"), [][]byte{squatter, owner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if best != 1 {
+		t.Errorf("selected record %d, want the owner's record 1", best)
+	}
+}
+
+func TestCheckNameRecordKey(t *testing.T) {
+	if _, err := checkNameRecord(nameKey("bob"), nameRecord(t, "alice", nameLifetime)); err == nil {
+		t.Error("record stored under another name was accepted")
+	}
+}
@@ -0,0 +1,262 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/pnet"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Supported connection security protocols
+const (
+	SecurityTLS   = "tls"
+	SecurityNoise = "noise"
+)
+
+// Option configures a Node created with NewNode.
+type Option func(*nodeConfig) error
+
+// nodeConfig holds the settings used to construct a Node.
+type nodeConfig struct {
+	identity       crypto.PrivKey
+	discoveryMode  string
+	bootstrapPeers []peer.AddrInfo
+	swarmKey       pnet.PSK
+	listenAddrs    []multiaddr.Multiaddr
+	listenPort     int
+	ipv6           bool
+	quic           bool
+	websocket      bool
+	websocketPort  int
+	security       []string
+	relayHop       bool
+	history        *HistoryStore
+	directHistory  *HistoryStore
+	downloads      DownloadOptions
+	blocks         *BlockStore
+}
+
+// defaultNodeConfig returns the settings used when no options are given.
+func defaultNodeConfig() nodeConfig {
+	return nodeConfig{
+		discoveryMode: DiscoveryDHT,
+		security:      []string{SecurityTLS},
+		downloads:     DownloadOptions{Dir: DefaultDownloadDir(), MaxSize: DefaultMaxFileSize},
+	}
+}
+
+// resolveListenAddrs returns the explicitly configured listen addresses,
+// or builds them from the configured ports and enabled transports.
+func (c nodeConfig) resolveListenAddrs() ([]multiaddr.Multiaddr, error) {
+	// QUIC does not support private networks in this libp2p version
+	if (c.quic || listensOn(c.listenAddrs, multiaddr.P_QUIC)) && c.swarmKey != nil {
+		return nil, errors.New("the QUIC transport cannot be used with a swarm key")
+	}
+	if len(c.listenAddrs) > 0 {
+		return c.listenAddrs, nil
+	}
+	if c.websocket && c.websocketPort == c.listenPort && c.listenPort != 0 {
+		return nil, fmt.Errorf("the WebSocket port must differ from the TCP port %d", c.listenPort)
+	}
+
+	hosts := []string{"/ip4/0.0.0.0"}
+	if c.ipv6 {
+		hosts = append(hosts, "/ip6/::")
+	}
+
+	var addrs []string
+	for _, h := range hosts {
+		addrs = append(addrs, fmt.Sprintf("%s/tcp/%d", h, c.listenPort))
+		if c.quic {
+			addrs = append(addrs, fmt.Sprintf("%s/udp/%d/quic", h, c.listenPort))
+		}
+		if c.websocket {
+			addrs = append(addrs, fmt.Sprintf("%s/tcp/%d/ws", h, c.websocketPort))
+		}
+	}
+
+	var maddrs []multiaddr.Multiaddr
+	for _, addr := range addrs {
+		maddr, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+		maddrs = append(maddrs, maddr)
+	}
+	return maddrs, nil
+}
+
+// listensOn reports whether any of the addresses uses the given protocol.
+func listensOn(addrs []multiaddr.Multiaddr, code int) bool {
+	for _, addr := range addrs {
+		for _, protocol := range addr.Protocols() {
+			if protocol.Code == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WithIdentity sets the private key that determines the node's peer ID.
+func WithIdentity(privateKey crypto.PrivKey) Option {
+	return func(c *nodeConfig) error {
+		c.identity = privateKey
+		return nil
+	}
+}
+
+// WithDiscoveryMode selects how peers are found (dht, mdns or both).
+func WithDiscoveryMode(mode string) Option {
+	return func(c *nodeConfig) error {
+		switch mode {
+		case DiscoveryDHT, DiscoveryMDNS, DiscoveryBoth:
+			c.discoveryMode = mode
+			return nil
+		default:
+			return fmt.Errorf("unknown discovery method %q", mode)
+		}
+	}
+}
+
+// WithBootstrapPeers sets the peers dialled to join the DHT.
+func WithBootstrapPeers(peers []peer.AddrInfo) Option {
+	return func(c *nodeConfig) error {
+		c.bootstrapPeers = peers
+		return nil
+	}
+}
+
+// WithSwarmKey restricts connections to peers holding the same pre-shared key.
+func WithSwarmKey(psk pnet.PSK) Option {
+	return func(c *nodeConfig) error {
+		c.swarmKey = psk
+		return nil
+	}
+}
+
+// WithListenAddrs sets the exact multiaddrs to listen on, overriding
+// the addresses derived from the port and transport options. The QUIC and
+// WebSocket transports are enabled for addresses that use them.
+func WithListenAddrs(addrs []string) Option {
+	return func(c *nodeConfig) error {
+		c.listenAddrs = nil
+		for _, addr := range addrs {
+			maddr, err := multiaddr.NewMultiaddr(addr)
+			if err != nil {
+				return fmt.Errorf("invalid listen address %q: %w", addr, err)
+			}
+			c.listenAddrs = append(c.listenAddrs, maddr)
+		}
+		return nil
+	}
+}
+
+// WithListenPort sets the TCP and QUIC port to listen on, 0 picks a random port.
+func WithListenPort(port int) Option {
+	return func(c *nodeConfig) error {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("invalid listen port %d", port)
+		}
+		c.listenPort = port
+		return nil
+	}
+}
+
+// WithIPv6 also listens on all IPv6 interfaces.
+func WithIPv6(enabled bool) Option {
+	return func(c *nodeConfig) error {
+		c.ipv6 = enabled
+		return nil
+	}
+}
+
+// WithQUIC enables the QUIC transport alongside TCP.
+func WithQUIC(enabled bool) Option {
+	return func(c *nodeConfig) error {
+		c.quic = enabled
+		return nil
+	}
+}
+
+// WithWebSocket enables the WebSocket transport on the given TCP port,
+// which must differ from the plain TCP port unless both are 0.
+func WithWebSocket(enabled bool, port int) Option {
+	return func(c *nodeConfig) error {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("invalid websocket port %d", port)
+		}
+		c.websocket = enabled
+		c.websocketPort = port
+		return nil
+	}
+}
+
+// WithSecurity sets the connection security protocols (tls, noise)
+// in order of preference.
+func WithSecurity(protocols ...string) Option {
+	return func(c *nodeConfig) error {
+		if len(protocols) == 0 {
+			return errors.New("at least one security protocol is required")
+		}
+		for _, protocol := range protocols {
+			if protocol != SecurityTLS && protocol != SecurityNoise {
+				return fmt.Errorf("unknown security protocol %q", protocol)
+			}
+		}
+		c.security = protocols
+		return nil
+	}
+}
+
+// WithRelayHop lets the node relay circuit traffic for other peers.
+func WithRelayHop(enabled bool) Option {
+	return func(c *nodeConfig) error {
+		c.relayHop = enabled
+		return nil
+	}
+}
+
+// WithHistory stores the messages of every joined room in the given store.
+func WithHistory(store *HistoryStore) Option {
+	return func(c *nodeConfig) error {
+		c.history = store
+		return nil
+	}
+}
+
+// WithDirectHistory stores direct messages in the given store, one log
+// per conversation partner.
+func WithDirectHistory(store *HistoryStore) Option {
+	return func(c *nodeConfig) error {
+		c.directHistory = store
+		return nil
+	}
+}
+
+// WithBlockStore keeps the blocks of shared files in the given store, so
+// files can be shared by CID and fetched from the peers holding them.
+func WithBlockStore(store *BlockStore) Option {
+	return func(c *nodeConfig) error {
+		c.blocks = store
+		return nil
+	}
+}
+
+// WithDownloads sets where accepted files are saved and which files are
+// accepted. An empty directory keeps the default one.
+func WithDownloads(options DownloadOptions) Option {
+	return func(c *nodeConfig) error {
+		if options.MaxSize < 0 {
+			return errors.New("maximum file size cannot be negative")
+		}
+		if options.Dir == "" {
+			options.Dir = DefaultDownloadDir()
+		}
+		c.downloads = options
+		return nil
+	}
+}
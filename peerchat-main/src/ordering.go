@@ -0,0 +1,168 @@
+package src
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// How long received messages are held back so messages that arrive
+	// late can still be shown in order
+	reorderWindow = time.Second
+	// How often held back messages are checked for release
+	reorderTick = 100 * time.Millisecond
+	// Largest step the room clock takes past a received message. Peers
+	// choose their clocks, so a larger jump would let one peer push the
+	// clock to its limit.
+	maxClockJump = 1 << 20
+)
+
+// heldMessage is a received message waiting in the reorder buffer.
+type heldMessage struct {
+	msg chatMsg
+	due time.Time
+}
+
+// stamp gives an outgoing message a unique ID, the sender's wall-clock
+// time and the next Lamport clock value of the room.
+func (c *ChatRoom) stamp(msg *chatMsg) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	msg.ID = hex.EncodeToString(id)
+	msg.Time = time.Now().UnixNano() / int64(time.Millisecond)
+
+	c.clockMutex.Lock()
+	defer c.clockMutex.Unlock()
+	c.clock++
+	msg.Clock = c.clock
+}
+
+// observeClock advances the room clock past a received message. Messages
+// of older clients without a clock are placed at the time they arrive,
+// and clocks more than maxClockJump ahead of ours are capped to it.
+func (c *ChatRoom) observeClock(msg *chatMsg) {
+	c.clockMutex.Lock()
+	defer c.clockMutex.Unlock()
+
+	switch {
+	case msg.Clock == 0:
+		c.clock++
+		msg.Clock = c.clock
+	case msg.Clock > c.clock+maxClockJump:
+		c.clock += maxClockJump
+		msg.Clock = c.clock
+	case msg.Clock > c.clock:
+		c.clock = msg.Clock
+	}
+}
+
+// messageBefore reports whether a message is ordered before another: by
+// Lamport clock, then by sender time, then by sender and ID so every peer
+// settles concurrent messages the same way.
+func messageBefore(a, b chatMsg) bool {
+	switch {
+	case a.Clock != b.Clock:
+		return a.Clock < b.Clock
+	case a.Time != b.Time:
+		return a.Time < b.Time
+	case a.SenderID != b.SenderID:
+		return a.SenderID < b.SenderID
+	}
+	return a.ID < b.ID
+}
+
+// holdMessage adds a received message to the reorder buffer. Our own
+// messages are released right away, together with every message ordered
+// before them.
+func (c *ChatRoom) holdMessage(msg chatMsg) {
+	now := time.Now()
+
+	c.heldMutex.Lock()
+	i := sort.Search(len(c.held), func(i int) bool {
+		return messageBefore(msg, c.held[i].msg)
+	})
+	c.held = append(c.held, heldMessage{})
+	copy(c.held[i+1:], c.held[i:])
+	c.held[i] = heldMessage{msg: msg, due: now.Add(reorderWindow)}
+
+	if msg.Self {
+		for j := 0; j <= i; j++ {
+			c.held[j].due = now
+		}
+	}
+	c.heldMutex.Unlock()
+
+	// Wake the release loop without blocking
+	select {
+	case c.heldWake <- struct{}{}:
+	default:
+	}
+}
+
+// releaseMessages delivers held messages in order once their reorder
+// window has passed. It closes IncomingMessages once the room is left or
+// its subscription ends.
+func (c *ChatRoom) releaseMessages() {
+	defer close(c.IncomingMessages)
+	ticker := time.NewTicker(reorderTick)
+	defer ticker.Stop()
+
+	for listening := true; listening; {
+		select {
+		case <-ticker.C:
+		case <-c.heldWake:
+		case <-c.listenDone:
+			// Deliver what is left before closing
+			listening = false
+			c.heldMutex.Lock()
+			for i := range c.held {
+				c.held[i].due = time.Time{}
+			}
+			c.heldMutex.Unlock()
+		case <-c.roomCtx.Done():
+			return
+		}
+
+		// A message only leaves after every message ordered before it
+		for {
+			c.heldMutex.Lock()
+			if len(c.held) == 0 || time.Now().Before(c.held[0].due) {
+				c.heldMutex.Unlock()
+				break
+			}
+			msg := c.held[0].msg
+			c.held = c.held[1:]
+			c.heldMutex.Unlock()
+
+			// Changes are only delivered once applied, and messages reusing
+			// the ID of an earlier one are dropped
+			if isChange(msg) {
+				if !c.applyChange(msg) {
+					continue
+				}
+			} else if msg.ID != "" && !c.messages.add(msg) {
+				logrus.Debugf("Dropped message %s from %s reusing a known ID", msg.ID, msg.SenderID)
+				continue
+			}
+
+			select {
+			case c.IncomingMessages <- msg:
+			case <-c.roomCtx.Done():
+				return
+			}
+		}
+	}
+}
+
+// sendTime returns the time a message was sent, or zero if the sender
+// did not say.
+func (msg chatMsg) sendTime() time.Time {
+	if msg.Time == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, msg.Time*int64(time.Millisecond))
+}
@@ -0,0 +1,36 @@
+package src
+
+import (
+	"math"
+	"testing"
+)
+
+func TestObserveClock(t *testing.T) {
+	c := &ChatRoom{clock: 10}
+
+	for _, tc := range []struct {
+		name     string
+		received uint64
+		msgClock uint64
+		clock    uint64
+	}{
+		{"behind", 5, 5, 10},
+		{"ahead", 20, 20, 20},
+		{"without clock", 0, 21, 21},
+		{"jump", 21 + maxClockJump, 21 + maxClockJump, 21 + maxClockJump},
+		{"too far ahead", math.MaxUint64, 21 + 2*maxClockJump, 21 + 2*maxClockJump},
+	} {
+		msg := chatMsg{Clock: tc.received}
+		c.observeClock(&msg)
+		if msg.Clock != tc.msgClock || c.clock != tc.clock {
+			t.Errorf("%s: message clock %d and room clock %d, want %d and %d", tc.name, msg.Clock, c.clock, tc.msgClock, tc.clock)
+		}
+	}
+
+	// The clock keeps counting after a capped jump
+	var msg chatMsg
+	c.stamp(&msg)
+	if msg.Clock != 22+2*maxClockJump {
+		t.Errorf("stamped clock %d, want %d", msg.Clock, 22+2*maxClockJump)
+	}
+}
@@ -1,15 +1,16 @@
-
 package src
 
 import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p"
+	circuit "github.com/libp2p/go-libp2p-circuit"
 	connmgr "github.com/libp2p/go-libp2p-connmgr"
 	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -17,10 +18,14 @@ import (
 	discovery "github.com/libp2p/go-libp2p-discovery"
 	host "github.com/libp2p/go-libp2p-host"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
+	noise "github.com/libp2p/go-libp2p-noise"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	libp2pquic "github.com/libp2p/go-libp2p-quic-transport"
 	tls "github.com/libp2p/go-libp2p-tls"
 	yamux "github.com/libp2p/go-libp2p-yamux"
+	mdns "github.com/libp2p/go-libp2p/p2p/discovery"
 	"github.com/libp2p/go-tcp-transport"
+	websocket "github.com/libp2p/go-ws-transport"
 	"github.com/mr-tron/base58/base58"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/multiformats/go-multihash"
@@ -29,126 +34,361 @@ import (
 
 const p2pServiceName = "peerchat/service"
 
+// Supported peer discovery methods
+const (
+	DiscoveryDHT  = "dht"
+	DiscoveryMDNS = "mdns"
+	DiscoveryBoth = "both"
+)
+
 type Node struct {
 	Context   context.Context
 	Host      host.Host
 	DHT       *dht.IpfsDHT
 	Discovery *discovery.RoutingDiscovery
 	PubSub    *pubsub.PubSub
+	// History stores room messages on disk, nil disables persistence
+	History *HistoryStore
+	// DirectHistory stores direct messages on disk, nil disables persistence
+	DirectHistory *HistoryStore
+	// DirectMessages delivers private messages received from peers
+	DirectMessages chan directMsg
+
+	cancelCtx     context.CancelFunc
+	discoveryMode string
+	mdnsService   mdns.Service
+
+	// Joined chat rooms by history key, used to serve history to peers
+	rooms      map[string]*ChatRoom
+	roomsMutex sync.Mutex
+
+	// Cached owners of registered names, and the renewal of our own name
+	names       map[string]cachedName
+	stopRenewal context.CancelFunc
+	namesMutex  sync.Mutex
+
+	// Files we offered by offer ID, and files offered to us
+	shared     map[string]*sharedFile
+	offered    map[string]*pendingOffer
+	filesMutex sync.Mutex
+	downloads  DownloadOptions
+
+	// Content-addressed blocks of shared files
+	Blocks *BlockStore
+
+	// File uploads and downloads in progress
+	Transfers *TransferManager
 }
 
-// InitializeNode sets up and returns a new P2P node.
-func InitializeNode() *Node {
-	mainCtx := context.Background()
-	p2pHost, kademliaDHT := createHost(mainCtx)
-	initializeDHT(mainCtx, p2pHost, kademliaDHT)
-	discoveryService := discovery.NewRoutingDiscovery(kademliaDHT)
-	pubSubSystem := initializePubSub(mainCtx, p2pHost, discoveryService)
-
-	return &Node{
-		Context:   mainCtx,
-		Host:      p2pHost,
-		DHT:       kademliaDHT,
-		Discovery: discoveryService,
-		PubSub:    pubSubSystem,
+// NewNode sets up and returns a new P2P node configured by the given options.
+// The node runs until ctx is cancelled or Close is called.
+func NewNode(ctx context.Context, opts ...Option) (*Node, error) {
+	config := defaultNodeConfig()
+	for _, opt := range opts {
+		if err := opt(&config); err != nil {
+			return nil, err
+		}
 	}
+
+	// Without a configured identity the node runs with a throwaway key
+	if config.identity == nil {
+		privateKey, _, err := crypto.GenerateKeyPairWithReader(crypto.Ed25519, -1, rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate private key: %w", err)
+		}
+		config.identity = privateKey
+	}
+
+	// Local-only discovery never dials the bootstrap peers
+	if config.discoveryMode == DiscoveryMDNS {
+		config.bootstrapPeers = nil
+	}
+
+	nodeCtx, cancel := context.WithCancel(ctx)
+	p2pHost, kademliaDHT, err := createHost(nodeCtx, config)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	node := &Node{
+		Context:        nodeCtx,
+		Host:           p2pHost,
+		DHT:            kademliaDHT,
+		History:        config.history,
+		DirectHistory:  config.directHistory,
+		DirectMessages: make(chan directMsg),
+		cancelCtx:      cancel,
+		discoveryMode:  config.discoveryMode,
+		rooms:          make(map[string]*ChatRoom),
+		names:          make(map[string]cachedName),
+		shared:         make(map[string]*sharedFile),
+		offered:        make(map[string]*pendingOffer),
+		downloads:      config.downloads,
+		Blocks:         config.blocks,
+		Transfers:      NewTransferManager(),
+	}
+	p2pHost.SetStreamHandler(historyProtocol, node.handleHistoryRequest)
+	p2pHost.SetStreamHandler(dmProtocol, node.handleDirectMessage)
+	p2pHost.SetStreamHandler(fileProtocol, node.handleFileRequest)
+	p2pHost.SetStreamHandler(blockProtocol, node.handleBlockRequest)
+	p2pHost.SetStreamHandler(wireProtocol, node.handleWireRequest)
+
+	if config.discoveryMode != DiscoveryMDNS {
+		if err := initializeDHT(nodeCtx, p2pHost, kademliaDHT, config.bootstrapPeers); err != nil {
+			node.Close()
+			return nil, err
+		}
+	}
+
+	node.Discovery = discovery.NewRoutingDiscovery(kademliaDHT)
+	node.PubSub, err = initializePubSub(nodeCtx, p2pHost, node.Discovery, config.relayHop)
+	if err != nil {
+		node.Close()
+		return nil, err
+	}
+
+	// Keep the shared files held locally announced in the DHT
+	if node.Blocks != nil && config.discoveryMode != DiscoveryMDNS {
+		go node.reprovideBlocks()
+	}
+
+	return node, nil
+}
+
+// Close shuts down peer discovery, PubSub, the DHT and the host.
+// The first error encountered is returned.
+func (n *Node) Close() error {
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if n.mdnsService != nil {
+		keep(n.mdnsService.Close())
+	}
+	// PubSub has no Close, it stops once the node context is cancelled
+	n.cancelCtx()
+	if n.DHT != nil {
+		keep(n.DHT.Close())
+	}
+	keep(n.Host.Close())
+
+	return firstErr
+}
+
+// DiscoverPeers connects to peers using the node's discovery mode.
+func (n *Node) DiscoverPeers() error {
+	if n.discoveryMode == DiscoveryMDNS || n.discoveryMode == DiscoveryBoth {
+		if err := n.StartMDNS(); err != nil {
+			return err
+		}
+	}
+	if n.discoveryMode == DiscoveryDHT || n.discoveryMode == DiscoveryBoth {
+		if err := n.AnnounceServiceCID(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FullAddrs returns the node's listen addresses including its peer ID.
+func (n *Node) FullAddrs() []multiaddr.Multiaddr {
+	peerAddr, _ := multiaddr.NewMultiaddr(fmt.Sprintf("/p2p/%s", n.Host.ID().Pretty()))
+
+	var addrs []multiaddr.Multiaddr
+	for _, addr := range n.Host.Addrs() {
+		addrs = append(addrs, addr.Encapsulate(peerAddr))
+	}
+	return addrs
 }
 
 // AnnounceServiceCID connects to peers providing the same CID.
-func (n *Node) AnnounceServiceCID() {
-	serviceCID := generateServiceCID(p2pServiceName)
+func (n *Node) AnnounceServiceCID() error {
+	serviceCID, err := generateServiceCID(p2pServiceName)
+	if err != nil {
+		return err
+	}
 	if err := n.DHT.Provide(n.Context, serviceCID, true); err != nil {
-		logrus.WithError(err).Fatal("Failed to announce service CID")
+		return fmt.Errorf("unable to announce service CID: %w", err)
 	}
 
 	time.Sleep(5 * time.Second)
 	providerStream := n.DHT.FindProvidersAsync(n.Context, serviceCID, 0)
-	go connectToDiscoveredPeers(n.Host, providerStream)
+	go connectToDiscoveredPeers(n.Context, n.Host, providerStream)
+	return nil
 }
 
 // createHost configures and returns a libp2p host and its DHT.
-func createHost(ctx context.Context) (host.Host, *dht.IpfsDHT) {
-	privateKey, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
+func createHost(ctx context.Context, config nodeConfig) (host.Host, *dht.IpfsDHT, error) {
+	privateKey := config.identity
+	listenAddrs, err := config.resolveListenAddrs()
 	if err != nil {
-		logrus.WithError(err).Fatal("Failed to generate private key")
+		return nil, nil, err
+	}
+	securityOptions, err := securityTransports(privateKey, config.security)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	listenAddr, _ := multiaddr.NewMultiaddr("/ip4/0.0.0.0/tcp/0")
-	tlsTransport, _ := tls.New(privateKey)
 
 	var kadDHT *dht.IpfsDHT
-	hostNode, err := libp2p.New(ctx,
+	options := []libp2p.Option{
 		libp2p.Identity(privateKey),
-		libp2p.ListenAddrs(listenAddr),
-		libp2p.Security(tls.ID, tlsTransport),
+		libp2p.PrivateNetwork(config.swarmKey),
+		libp2p.ListenAddrs(listenAddrs...),
+		libp2p.ChainOptions(securityOptions...),
 		libp2p.Transport(tcp.NewTCPTransport),
 		libp2p.Muxer("/yamux/1.0.0", yamux.DefaultTransport),
 		libp2p.ConnectionManager(connmgr.NewConnManager(100, 400, time.Minute)),
 		libp2p.NATPortMap(),
-		libp2p.EnableAutoRelay(),
 		libp2p.Routing(func(h host.Host) (routing.PeerRouting, error) {
-			kadDHT = initializeKademliaDHT(ctx, h)
-			return kadDHT, nil
+			var err error
+			kadDHT, err = initializeKademliaDHT(ctx, h, config.bootstrapPeers)
+			return kadDHT, err
 		}),
-	)
+	}
+
+	// Explicit listen addresses enable the transports they use
+	if config.quic || listensOn(listenAddrs, multiaddr.P_QUIC) {
+		options = append(options, libp2p.Transport(libp2pquic.NewTransport))
+	}
+	if config.websocket || listensOn(listenAddrs, multiaddr.P_WS) {
+		options = append(options, libp2p.Transport(websocket.New))
+	}
+
+	// Relay servers accept circuits for others, everyone else looks for relays
+	if config.relayHop {
+		options = append(options, libp2p.EnableRelay(circuit.OptHop))
+	} else {
+		options = append(options, libp2p.EnableAutoRelay())
+	}
+
+	hostNode, err := libp2p.New(ctx, options...)
 	if err != nil {
-		logrus.WithError(err).Fatal("Failed to create host")
+		return nil, nil, fmt.Errorf("unable to create host: %w", err)
 	}
 
-	return hostNode, kadDHT
+	return hostNode, kadDHT, nil
+}
+
+// securityTransports returns the libp2p security options for the
+// given protocols, in order of preference.
+func securityTransports(privateKey crypto.PrivKey, protocols []string) ([]libp2p.Option, error) {
+	var options []libp2p.Option
+	for _, protocol := range protocols {
+		switch protocol {
+		case SecurityTLS:
+			tlsTransport, err := tls.New(privateKey)
+			if err != nil {
+				return nil, fmt.Errorf("unable to create TLS transport: %w", err)
+			}
+			options = append(options, libp2p.Security(tls.ID, tlsTransport))
+		case SecurityNoise:
+			noiseTransport, err := noise.New(privateKey)
+			if err != nil {
+				return nil, fmt.Errorf("unable to create Noise transport: %w", err)
+			}
+			options = append(options, libp2p.Security(noise.ID, noiseTransport))
+		default:
+			return nil, fmt.Errorf("unknown security protocol %q", protocol)
+		}
+	}
+	return options, nil
 }
 
 // initializeKademliaDHT configures and returns a Kademlia DHT.
-func initializeKademliaDHT(ctx context.Context, h host.Host) *dht.IpfsDHT {
-	dhtNode, _ := dht.New(ctx, h, dht.Mode(dht.ModeServer), dht.BootstrapPeers(dht.GetDefaultBootstrapPeerAddrInfos()...))
-	return dhtNode
+// Without bootstrap peers the DHT only learns about peers found locally.
+// Name records are accepted under the peerchat namespace. Public IPFS DHT
+// servers reject that namespace, so the name registry only works on a DHT
+// of peerchat nodes, such as a private network with peerchat bootstrap
+// nodes.
+func initializeKademliaDHT(ctx context.Context, h host.Host, bootstrapPeers []peer.AddrInfo) (*dht.IpfsDHT, error) {
+	dhtNode, err := dht.New(ctx, h,
+		dht.Mode(dht.ModeServer),
+		dht.BootstrapPeers(bootstrapPeers...),
+		dht.NamespacedValidator(nameNamespace, newNameValidator()),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create DHT: %w", err)
+	}
+	return dhtNode, nil
 }
 
 // initializeDHT bootstraps the DHT to connect to peers.
-func initializeDHT(ctx context.Context, h host.Host, dhtNode *dht.IpfsDHT) {
+// It fails only if none of the bootstrap peers could be reached.
+func initializeDHT(ctx context.Context, h host.Host, dhtNode *dht.IpfsDHT, bootstrapPeers []peer.AddrInfo) error {
 	if err := dhtNode.Bootstrap(ctx); err != nil {
-		logrus.WithError(err).Fatal("Failed to bootstrap DHT")
+		return fmt.Errorf("unable to bootstrap DHT: %w", err)
 	}
 
 	var wg sync.WaitGroup
-	for _, bootstrapAddr := range dht.DefaultBootstrapPeers {
-		peerInfo, _ := peer.AddrInfoFromP2pAddr(bootstrapAddr)
+	var mutex sync.Mutex
+	var connected int
+	var lastErr error
+	for _, peerInfo := range bootstrapPeers {
 		wg.Add(1)
 		go func(info peer.AddrInfo) {
 			defer wg.Done()
-			h.Connect(ctx, info)
-		}(*peerInfo)
+			err := h.Connect(ctx, info)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				logrus.WithError(err).Debugf("Failed to connect to bootstrap peer %s", info.ID)
+				lastErr = err
+				return
+			}
+			connected++
+		}(peerInfo)
 	}
 	wg.Wait()
-	logrus.Info("Bootstrapped DHT and connected to peers")
+
+	if len(bootstrapPeers) > 0 && connected == 0 {
+		return fmt.Errorf("unable to connect to any bootstrap peer: %w", lastErr)
+	}
+	logrus.Infof("Bootstrapped DHT and connected to %d peers", connected)
+	return nil
 }
 
 // initializePubSub sets up a PubSub system with discovery.
-func initializePubSub(ctx context.Context, h host.Host, discoveryService *discovery.RoutingDiscovery) *pubsub.PubSub {
-	pubSubSystem, err := pubsub.NewGossipSub(ctx, h, pubsub.WithDiscovery(discoveryService))
+// Every message is signed and unsigned or forged messages are rejected,
+// so the From field of a received message identifies its author.
+// Infrastructure nodes also share their peers when pruning the mesh.
+func initializePubSub(ctx context.Context, h host.Host, discoveryService *discovery.RoutingDiscovery, peerExchange bool) (*pubsub.PubSub, error) {
+	pubSubSystem, err := pubsub.NewGossipSub(ctx, h,
+		pubsub.WithDiscovery(discoveryService),
+		pubsub.WithPeerExchange(peerExchange),
+		pubsub.WithMessageSigning(true),
+		pubsub.WithStrictSignatureVerification(true),
+	)
 	if err != nil {
-		logrus.WithError(err).Fatal("Failed to initialize PubSub system")
+		return nil, fmt.Errorf("unable to initialize PubSub system: %w", err)
 	}
-	return pubSubSystem
+	return pubSubSystem, nil
 }
 
 // connectToDiscoveredPeers handles connecting to peers from a channel.
-func connectToDiscoveredPeers(h host.Host, peerStream <-chan peer.AddrInfo) {
+func connectToDiscoveredPeers(ctx context.Context, h host.Host, peerStream <-chan peer.AddrInfo) {
 	for peerInfo := range peerStream {
-		if peerInfo.ID != h.ID() {
-			h.Connect(context.Background(), peerInfo)
+		if peerInfo.ID == h.ID() {
+			continue
+		}
+		if err := h.Connect(ctx, peerInfo); err != nil {
+			logrus.WithError(err).Debugf("Failed to connect to discovered peer %s", peerInfo.ID)
 		}
 	}
 }
 
 // generateServiceCID creates a CID for a given service name.
-func generateServiceCID(name string) cid.Cid {
+func generateServiceCID(name string) (cid.Cid, error) {
 	hasher := sha256.New()
 	hasher.Write([]byte(name))
 	hashBytes := append([]byte{0x12, 0x20}, hasher.Sum(nil)...)
 	multiHash, err := multihash.FromB58String(base58.Encode(hashBytes))
 	if err != nil {
-		logrus.WithError(err).Fatal("Failed to create CID")
+		return cid.Undef, fmt.Errorf("unable to create CID: %w", err)
 	}
-	return cid.NewCidV1(12, multiHash)
-}
\ No newline at end of file
+	return cid.NewCidV1(12, multiHash), nil
+}
@@ -0,0 +1,158 @@
+package src
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+// Version of the client announced in presence heartbeats
+const ClientVersion = "peerchat/1.0"
+
+const (
+	// How often a room member announces its presence
+	presenceInterval = 15 * time.Second
+	// How long a peer is listed after its last heartbeat
+	presenceExpiry = 3 * presenceInterval
+	// How long without sending a message before a member shows as idle
+	idleAfter = 5 * time.Minute
+)
+
+// Presence states announced in heartbeats
+const (
+	StatusOnline  = "online"
+	StatusIdle    = "idle"
+	StatusAway    = "away"
+	StatusOffline = "offline"
+)
+
+// presenceInfo is the last heartbeat received from a room peer.
+type presenceInfo struct {
+	Name     string
+	Status   string
+	Version  string
+	LastSeen time.Time
+}
+
+// PeerPresence describes a room peer with a live heartbeat.
+type PeerPresence struct {
+	ID      peer.ID
+	Name    string
+	Status  string
+	Version string
+}
+
+// announcePresence publishes a heartbeat when the room is joined and
+// then every presenceInterval until the room is left.
+func (c *ChatRoom) announcePresence() {
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+
+	for {
+		c.publishPresence(c.roomCtx, c.currentStatus())
+
+		select {
+		case <-ticker.C:
+		case <-c.roomCtx.Done():
+			return
+		}
+	}
+}
+
+// publishPresence publishes a single heartbeat with the given status.
+func (c *ChatRoom) publishPresence(ctx context.Context, status string) {
+	message := chatMsg{
+		SenderID:   c.hostID.Pretty(),
+		SenderName: c.Username,
+		MsgType:    "presence",
+		Status:     status,
+		Version:    ClientVersion,
+	}
+
+	data, err := c.encodeMessage(message)
+	if err != nil {
+		return
+	}
+	if err := c.topic.Publish(ctx, data); err != nil && ctx.Err() == nil {
+		logrus.WithError(err).Debug("Failed to publish presence")
+	}
+}
+
+// currentStatus returns the status announced for the local user.
+func (c *ChatRoom) currentStatus() string {
+	c.presenceMutex.Lock()
+	defer c.presenceMutex.Unlock()
+
+	switch {
+	case c.away:
+		return StatusAway
+	case time.Since(c.lastActive) > idleAfter:
+		return StatusIdle
+	default:
+		return StatusOnline
+	}
+}
+
+// markActive records that the local user sent a message.
+func (c *ChatRoom) markActive() {
+	c.presenceMutex.Lock()
+	defer c.presenceMutex.Unlock()
+	c.lastActive = time.Now()
+}
+
+// SetAway marks the local user as away, or back, and announces the
+// change right away.
+func (c *ChatRoom) SetAway(away bool) {
+	c.presenceMutex.Lock()
+	c.away = away
+	if !away {
+		c.lastActive = time.Now()
+	}
+	c.presenceMutex.Unlock()
+
+	go c.publishPresence(c.roomCtx, c.currentStatus())
+}
+
+// updatePresence stores a heartbeat received from a room peer.
+func (c *ChatRoom) updatePresence(from peer.ID, msg chatMsg) {
+	c.presenceMutex.Lock()
+	defer c.presenceMutex.Unlock()
+
+	if msg.Status == StatusOffline {
+		delete(c.presence, from)
+		return
+	}
+	c.presence[from] = presenceInfo{
+		Name:     msg.SenderName,
+		Status:   msg.Status,
+		Version:  msg.Version,
+		LastSeen: time.Now(),
+	}
+}
+
+// PresentPeers returns the room peers with a live heartbeat, sorted by
+// name. Peers whose heartbeats expired are forgotten.
+func (c *ChatRoom) PresentPeers() []PeerPresence {
+	c.presenceMutex.Lock()
+	defer c.presenceMutex.Unlock()
+
+	var peers []PeerPresence
+	for id, info := range c.presence {
+		if time.Since(info.LastSeen) > presenceExpiry {
+			delete(c.presence, id)
+			continue
+		}
+		peers = append(peers, PeerPresence{ID: id, Name: info.Name, Status: info.Status, Version: info.Version})
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Name != peers[j].Name {
+			return peers[i].Name < peers[j].Name
+		}
+		return peers[i].ID < peers[j].ID
+	})
+	return peers
+}
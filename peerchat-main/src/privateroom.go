@@ -0,0 +1,90 @@
+package src
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Size of a symmetric room key in bytes
+const RoomKeySize = chacha20poly1305.KeySize
+
+// NewRoomKey generates a random room key, for rooms shared through invites.
+func NewRoomKey() ([]byte, error) {
+	key := make([]byte, RoomKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DeriveRoomKey derives the key of a private room from a shared passphrase.
+// The room name salts the derivation, so the same passphrase gives each
+// room a different key.
+func DeriveRoomKey(room, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("a private room needs a passphrase")
+	}
+	salt := []byte("peerchat-room:" + room)
+	return scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, RoomKeySize)
+}
+
+// JoinPrivateRoom joins an end-to-end encrypted room. Every payload is
+// sealed with the room key and the PubSub topic is derived from the key,
+// so the human-readable room name never appears on the network.
+func JoinPrivateRoom(node *Node, username, room string, key []byte) (*ChatRoom, error) {
+	if len(key) != RoomKeySize {
+		return nil, fmt.Errorf("room key must be %d bytes", RoomKeySize)
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return joinRoom(node, username, room, privateRoomTopic(key), aead, key)
+}
+
+// privateRoomTopic returns the PubSub topic name of a private room.
+func privateRoomTopic(key []byte) string {
+	digest := sha256.Sum256(append([]byte("peerchat-topic:"), key...))
+	return "chatroom-private-" + hex.EncodeToString(digest[:16])
+}
+
+// IsPrivate reports whether the room is end-to-end encrypted.
+func (c *ChatRoom) IsPrivate() bool {
+	return c.roomCipher != nil
+}
+
+// sealPayload encrypts an outgoing payload for a private room. Payloads
+// of public rooms are returned unchanged.
+func (c *ChatRoom) sealPayload(data []byte) ([]byte, error) {
+	if c.roomCipher == nil {
+		return data, nil
+	}
+
+	nonce := make([]byte, c.roomCipher.NonceSize(), c.roomCipher.NonceSize()+len(data)+c.roomCipher.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// The topic is authenticated so a payload cannot be replayed elsewhere
+	return c.roomCipher.Seal(nonce, nonce, data, []byte(c.topicName)), nil
+}
+
+// openPayload decrypts an incoming payload of a private room. Payloads
+// of public rooms are returned unchanged.
+func (c *ChatRoom) openPayload(data []byte) ([]byte, error) {
+	if c.roomCipher == nil {
+		return data, nil
+	}
+
+	nonceSize := c.roomCipher.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("payload too short")
+	}
+	return c.roomCipher.Open(nil, data[:nonceSize], data[nonceSize:], []byte(c.topicName))
+}
@@ -0,0 +1,102 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Longest reaction accepted, in characters
+const maxReactionLength = 8
+
+// Names accepted by /react for common reactions
+var reactionAliases = map[string]string{
+	"+1":    "👍",
+	"-1":    "👎",
+	"check": "✅",
+	"eyes":  "👀",
+	"heart": "❤️",
+	"laugh": "😄",
+	"tada":  "🎉",
+}
+
+// reaction is one emoji added to a message with the peers that added it,
+// in the order they did.
+type reaction struct {
+	Emoji   string
+	Senders []string
+}
+
+// React publishes a reaction to a message of the room.
+func (c *ChatRoom) React(id, emoji string) error {
+	emoji, err := parseReaction(emoji)
+	if err != nil {
+		return err
+	}
+
+	msg, ok := c.messages.get(id)
+	switch {
+	case !ok:
+		return fmt.Errorf("no message #%s in this room", messageRef(id))
+	case msg.Retracted:
+		return fmt.Errorf("message #%s was deleted", messageRef(id))
+	case msg.MsgType != "" && msg.MsgType != "text":
+		return fmt.Errorf("message #%s is not a text message", messageRef(id))
+	}
+	return c.publishChange("react", id, emoji)
+}
+
+// parseReaction returns the emoji of a reaction given as an emoji or as
+// one of the reaction names, with or without colons.
+func parseReaction(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if emoji, ok := reactionAliases[strings.Trim(text, ":")]; ok {
+		return emoji, nil
+	}
+	if !validReaction(text) {
+		return "", errors.New("a reaction is a single emoji or short word")
+	}
+	return text, nil
+}
+
+// validReaction reports whether a received reaction is short and free of
+// whitespace.
+func validReaction(emoji string) bool {
+	if emoji == "" || utf8.RuneCountInString(emoji) > maxReactionLength {
+		return false
+	}
+	return len(strings.Fields(emoji)) == 1 && strings.TrimSpace(emoji) == emoji
+}
+
+// addReaction adds a reaction to the text message it targets. Every peer
+// counts once per emoji. It reports whether the message changed.
+func addReaction(target *chatMsg, change chatMsg) bool {
+	if target.Retracted || !validReaction(change.Text) {
+		return false
+	}
+	if target.MsgType != "" && target.MsgType != "text" {
+		return false
+	}
+
+	// Copies of the message share the slices, so they are never changed
+	// in place
+	reactions := make([]reaction, len(target.Reactions))
+	copy(reactions, target.Reactions)
+	for i, r := range reactions {
+		if r.Emoji != change.Text {
+			continue
+		}
+		for _, sender := range r.Senders {
+			if sender == change.SenderID {
+				return false
+			}
+		}
+		reactions[i].Senders = append(append([]string(nil), r.Senders...), change.SenderID)
+		target.Reactions = reactions
+		return true
+	}
+
+	target.Reactions = append(reactions, reaction{Emoji: change.Text, Senders: []string{change.SenderID}})
+	return true
+}
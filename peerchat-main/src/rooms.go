@@ -0,0 +1,151 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// RoomManager keeps several joined chat rooms subscribed at the same
+// time, in the order they were joined, and tracks which one is shown.
+type RoomManager struct {
+	rooms  []*ChatRoom
+	active *ChatRoom
+	mutex  sync.Mutex
+}
+
+// NewRoomManager returns a manager holding the given room as the active one.
+func NewRoomManager(cr *ChatRoom) *RoomManager {
+	return &RoomManager{rooms: []*ChatRoom{cr}, active: cr}
+}
+
+// Add adds a joined room and reports whether it was not managed yet.
+func (m *RoomManager) Add(cr *ChatRoom) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.index(cr) >= 0 {
+		return false
+	}
+	m.rooms = append(m.rooms, cr)
+	return true
+}
+
+// Rooms returns the managed rooms in the order they were joined.
+func (m *RoomManager) Rooms() []*ChatRoom {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	rooms := make([]*ChatRoom, len(m.rooms))
+	copy(rooms, m.rooms)
+	return rooms
+}
+
+// Active returns the room currently shown.
+func (m *RoomManager) Active() *ChatRoom {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.active
+}
+
+// SetActive marks a managed room as the one shown.
+func (m *RoomManager) SetActive(cr *ChatRoom) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.index(cr) >= 0 {
+		m.active = cr
+	}
+}
+
+// At returns the room at a position in join order, or nil.
+func (m *RoomManager) At(i int) *ChatRoom {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if i < 0 || i >= len(m.rooms) {
+		return nil
+	}
+	return m.rooms[i]
+}
+
+// Next returns the room offset positions away from the active one,
+// wrapping around at either end.
+func (m *RoomManager) Next(offset int) *ChatRoom {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	n := len(m.rooms)
+	if n == 0 {
+		return nil
+	}
+	i := ((m.index(m.active)+offset)%n + n) % n
+	return m.rooms[i]
+}
+
+// Find returns the managed room with the given name, or nil. The active
+// room wins when a public and a private room share the name.
+func (m *RoomManager) Find(name string) *ChatRoom {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.active != nil && m.active.RoomName == name {
+		return m.active
+	}
+	for _, cr := range m.rooms {
+		if cr.RoomName == name {
+			return cr
+		}
+	}
+	return nil
+}
+
+// Part leaves a managed room. The last room cannot be left, so there is
+// always a room to show. If the active room is left, its neighbour
+// becomes active.
+func (m *RoomManager) Part(cr *ChatRoom) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	i := m.index(cr)
+	if i < 0 {
+		return fmt.Errorf("not a member of room '%s'", cr.RoomName)
+	}
+	if len(m.rooms) == 1 {
+		return errors.New("cannot leave the last room, use /quit to exit")
+	}
+
+	m.rooms = append(m.rooms[:i], m.rooms[i+1:]...)
+	if m.active == cr {
+		if i == len(m.rooms) {
+			i--
+		}
+		m.active = m.rooms[i]
+	}
+
+	cr.Leave()
+	return nil
+}
+
+// LeaveAll leaves every managed room.
+func (m *RoomManager) LeaveAll() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, cr := range m.rooms {
+		cr.Leave()
+	}
+	m.rooms = nil
+	m.active = nil
+}
+
+// index returns the position of a room, or -1. The caller must hold the
+// manager mutex.
+func (m *RoomManager) index(cr *ChatRoom) int {
+	for i, room := range m.rooms {
+		if room == cr {
+			return i
+		}
+	}
+	return -1
+}
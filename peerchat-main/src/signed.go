@@ -0,0 +1,73 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// signedPayload wraps a JSON payload with the signature of the peer it
+// names, such as an invite or a name record. The public key is only
+// included when it cannot be extracted from the signer's peer ID.
+type signedPayload struct {
+	Payload   []byte `json:"p"`
+	PublicKey []byte `json:"pk,omitempty"`
+	Signature []byte `json:"s"`
+}
+
+// signPayload serializes a payload and signs it with a node key, after a
+// prefix that separates the kinds of signed payloads.
+func signPayload(privateKey crypto.PrivKey, prefix string, v interface{}) (signedPayload, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return signedPayload{}, err
+	}
+
+	signature, err := privateKey.Sign(append([]byte(prefix), payload...))
+	if err != nil {
+		return signedPayload{}, fmt.Errorf("unable to sign payload: %w", err)
+	}
+	signed := signedPayload{Payload: payload, Signature: signature}
+
+	id, err := peer.IDFromPrivateKey(privateKey)
+	if err != nil {
+		return signedPayload{}, err
+	}
+	if _, err := id.ExtractPublicKey(); err != nil {
+		if signed.PublicKey, err = crypto.MarshalPublicKey(privateKey.GetPublic()); err != nil {
+			return signedPayload{}, err
+		}
+	}
+	return signed, nil
+}
+
+// verify checks that the payload was signed after the given prefix by
+// the key behind the signer's peer ID, and returns that ID.
+func (s signedPayload) verify(prefix, signer string) (peer.ID, error) {
+	id, err := peer.Decode(signer)
+	if err != nil {
+		return "", fmt.Errorf("invalid signer ID: %w", err)
+	}
+
+	var publicKey crypto.PubKey
+	if s.PublicKey != nil {
+		publicKey, err = crypto.UnmarshalPublicKey(s.PublicKey)
+		if err == nil && !id.MatchesPublicKey(publicKey) {
+			err = errors.New("public key does not match signer")
+		}
+	} else {
+		publicKey, err = id.ExtractPublicKey()
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to get signer key: %w", err)
+	}
+
+	valid, err := publicKey.Verify(append([]byte(prefix), s.Payload...), s.Signature)
+	if err != nil || !valid {
+		return "", errors.New("invalid signature")
+	}
+	return id, nil
+}
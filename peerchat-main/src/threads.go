@@ -0,0 +1,176 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	// Length of the short message references shown and accepted by /reply
+	messageRefLength = 6
+	// Most messages of a room kept for replies and threads
+	maxIndexedMessages = 10000
+)
+
+// messageIndex keeps the messages of a room by ID in delivery order, so
+// replies can quote their parent and threads can be rebuilt.
+type messageIndex struct {
+	messages map[string]chatMsg
+	order    []string
+	mutex    sync.Mutex
+}
+
+// threadEntry is a message of a thread with its depth in the reply tree.
+type threadEntry struct {
+	msg   chatMsg
+	depth int
+}
+
+// newMessageIndex returns an empty message index.
+func newMessageIndex() *messageIndex {
+	return &messageIndex{messages: make(map[string]chatMsg)}
+}
+
+// add indexes a message, forgetting the oldest ones beyond the limit. It
+// reports whether the message was new. IDs are chosen by senders, so the
+// first message seen with an ID is kept and a later one reusing the ID,
+// from another peer or repeated, is not indexed.
+func (x *messageIndex) add(msg chatMsg) bool {
+	if msg.ID == "" {
+		return false
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if _, ok := x.messages[msg.ID]; ok {
+		return false
+	}
+	x.order = append(x.order, msg.ID)
+	x.messages[msg.ID] = msg
+
+	if len(x.order) > maxIndexedMessages {
+		delete(x.messages, x.order[0])
+		x.order = x.order[1:]
+	}
+	return true
+}
+
+// get returns an indexed message by ID.
+func (x *messageIndex) get(id string) (chatMsg, bool) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	msg, ok := x.messages[id]
+	return msg, ok
+}
+
+// update changes an indexed message in place. The change function reports
+// whether it changed the message.
+func (x *messageIndex) update(id string, change func(msg *chatMsg) bool) bool {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	msg, ok := x.messages[id]
+	if !ok || !change(&msg) {
+		return false
+	}
+	x.messages[id] = msg
+	return true
+}
+
+// resolve returns the message with the given ID or short reference.
+func (x *messageIndex) resolve(ref string) (chatMsg, error) {
+	ref = strings.TrimPrefix(ref, "#")
+	if ref == "" {
+		return chatMsg{}, errors.New("missing message reference")
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if msg, ok := x.messages[ref]; ok {
+		return msg, nil
+	}
+
+	var matches []chatMsg
+	for _, id := range x.order {
+		if strings.HasSuffix(id, ref) {
+			matches = append(matches, x.messages[id])
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return chatMsg{}, fmt.Errorf("no message #%s in this room", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return chatMsg{}, fmt.Errorf("#%s matches %d messages, use a longer reference", ref, len(matches))
+	}
+}
+
+// thread returns the reply tree containing a message, starting from its
+// root, with replies after their parent in delivery order.
+func (x *messageIndex) thread(id string) []threadEntry {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	// Walk up to the oldest known ancestor, guarding against cycles
+	root, ok := x.messages[id]
+	if !ok {
+		return nil
+	}
+	visited := map[string]bool{root.ID: true}
+	for root.ReplyTo != "" && !visited[root.ReplyTo] {
+		parent, ok := x.messages[root.ReplyTo]
+		if !ok {
+			break
+		}
+		visited[parent.ID] = true
+		root = parent
+	}
+
+	children := make(map[string][]string)
+	for _, childID := range x.order {
+		if parent := x.messages[childID].ReplyTo; parent != "" {
+			children[parent] = append(children[parent], childID)
+		}
+	}
+
+	var entries []threadEntry
+	seen := make(map[string]bool)
+	var walk func(id string, depth int)
+	walk = func(id string, depth int) {
+		if seen[id] {
+			return
+		}
+		seen[id] = true
+		entries = append(entries, threadEntry{msg: x.messages[id], depth: depth})
+		for _, child := range children[id] {
+			walk(child, depth+1)
+		}
+	}
+	walk(root.ID, 0)
+	return entries
+}
+
+// messageRef returns the short reference of a message ID.
+func messageRef(id string) string {
+	if len(id) <= messageRefLength {
+		return id
+	}
+	return id[len(id)-messageRefLength:]
+}
+
+// Reply publishes a text message answering an earlier message of the room.
+func (c *ChatRoom) Reply(parentID, text string) error {
+	parent, ok := c.messages.get(parentID)
+	if !ok {
+		return fmt.Errorf("no message #%s in this room", messageRef(parentID))
+	}
+	if parent.Retracted {
+		return fmt.Errorf("message #%s was deleted", messageRef(parentID))
+	}
+	return c.publishText(text, parentID)
+}
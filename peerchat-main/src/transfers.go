@@ -0,0 +1,201 @@
+package src
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Directions of a file transfer
+const (
+	TransferUpload   = "upload"
+	TransferDownload = "download"
+)
+
+// transfer is a file upload or download in progress.
+type transfer struct {
+	id        int
+	name      string
+	peer      peer.ID
+	direction string
+	size      int64
+	started   time.Time
+	cancel    context.CancelFunc
+
+	// done counts the bytes present so far, including those kept from an
+	// interrupted attempt, transferred only those moved by this transfer
+	done        int64
+	transferred int64
+	mutex       sync.Mutex
+}
+
+// TransferInfo describes the progress of a file transfer.
+type TransferInfo struct {
+	ID        string
+	Name      string
+	Peer      peer.ID
+	Direction string
+	// Size is the total size in bytes, 0 when it is not known
+	Size int64
+	Done int64
+	// Rate is the average speed in bytes per second since the start
+	Rate float64
+	// ETA is the estimated time left, 0 when it is not known
+	ETA time.Duration
+}
+
+// TransferManager tracks every file transfer in progress so it can be
+// shown and cancelled.
+type TransferManager struct {
+	transfers map[int]*transfer
+	lastID    int
+	mutex     sync.Mutex
+}
+
+// NewTransferManager returns an empty transfer manager.
+func NewTransferManager() *TransferManager {
+	return &TransferManager{transfers: make(map[int]*transfer)}
+}
+
+// start registers a transfer and returns it with a context that is
+// cancelled when the transfer is cancelled.
+func (m *TransferManager) start(ctx context.Context, name string, p peer.ID, direction string, size int64) (*transfer, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.lastID++
+	t := &transfer{
+		id:        m.lastID,
+		name:      name,
+		peer:      p,
+		direction: direction,
+		size:      size,
+		started:   time.Now(),
+		cancel:    cancel,
+	}
+	m.transfers[t.id] = t
+	return t, ctx
+}
+
+// finish removes a completed, failed or cancelled transfer.
+func (m *TransferManager) finish(t *transfer) {
+	m.mutex.Lock()
+	delete(m.transfers, t.id)
+	m.mutex.Unlock()
+
+	t.cancel()
+}
+
+// Cancel stops a transfer in progress.
+func (m *TransferManager) Cancel(id string) error {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return fmt.Errorf("invalid transfer ID '%s'", id)
+	}
+
+	m.mutex.Lock()
+	t, ok := m.transfers[n]
+	m.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("no transfer with ID '%s'", id)
+	}
+
+	t.cancel()
+	return nil
+}
+
+// List returns the transfers in progress in the order they started.
+func (m *TransferManager) List() []TransferInfo {
+	m.mutex.Lock()
+	transfers := make([]*transfer, 0, len(m.transfers))
+	for _, t := range m.transfers {
+		transfers = append(transfers, t)
+	}
+	m.mutex.Unlock()
+
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].id < transfers[j].id
+	})
+
+	infos := make([]TransferInfo, len(transfers))
+	for i, t := range transfers {
+		infos[i] = t.info()
+	}
+	return infos
+}
+
+// info returns the current progress of a transfer.
+func (t *transfer) info() TransferInfo {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	info := TransferInfo{
+		ID:        strconv.Itoa(t.id),
+		Name:      t.name,
+		Peer:      t.peer,
+		Direction: t.direction,
+		Size:      t.size,
+		Done:      t.done,
+	}
+
+	// Bytes resumed from an earlier attempt do not count towards the rate
+	if elapsed := time.Since(t.started).Seconds(); elapsed > 0 {
+		info.Rate = float64(t.transferred) / elapsed
+	}
+	if info.Rate > 0 && t.size > t.done {
+		info.ETA = time.Duration(float64(t.size-t.done) / info.Rate * float64(time.Second))
+	}
+	return info
+}
+
+// add records transferred bytes. It does nothing on a nil transfer.
+func (t *transfer) add(n int64) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.done += n
+	t.transferred += n
+}
+
+// resume sets the bytes already present when an attempt starts, such as
+// the verified chunks of an interrupted download. It does nothing on a
+// nil transfer.
+func (t *transfer) resume(n int64) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.done = n
+}
+
+// resetOnCancel resets a stream when the context is cancelled, so reads
+// and writes blocked on it return. The returned function stops watching.
+func resetOnCancel(ctx context.Context, s network.Stream) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			s.Reset()
+		case <-stop:
+		}
+	}()
+
+	// Wait for the watcher, so a stream closed afterwards is never reset
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
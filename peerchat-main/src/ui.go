@@ -1,6 +1,7 @@
 package src
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -11,8 +12,10 @@ import (
 
 // A structure that represents the ChatRoom UI
 type UI struct {
-	// Represents the ChatRoom (embedded)
+	// Represents the active ChatRoom (embedded)
 	*ChatRoom
+	// Represents every joined ChatRoom
+	Rooms *RoomManager
 	// Represents the tview application
 	TerminalApp *tview.Application
 
@@ -20,11 +23,38 @@ type UI struct {
 	MsgInputs chan string
 	// Represents the user command input queue
 	CmdInputs chan uicommand
+	// Represents the queue of rooms to show or remove
+	roomChanges chan roomchange
+	// Represents the queue of events from all joined rooms
+	roomEvents chan roomevent
+	// Closed when the tview application stops
+	done chan struct{}
 
+	// Represents the UI state of each joined room
+	views map[*ChatRoom]*roomview
+	// Represents the file offers waiting for an answer, only
+	// accessed from the tview event loop
+	offerQueue []offerprompt
+
+	// Represents the UI element layering prompts over the main layout
+	layers *tview.Pages
+
+	// Represents the UI element with the list of joined rooms
+	roomBox *tview.TextView
 	// Represents the UI element with the list of peers
 	peerBox *tview.TextView
-	// Represents the UI element with the chat messages and logs
+	// Represents the UI element holding the message box of each room
+	messagePages *tview.Pages
+	// Represents the UI element with the active room's messages and logs
 	messageBox *tview.TextView
+	// Represents the UI element with the direct message conversations
+	dmBox *tview.TextView
+	// Represents the UI element with the file transfers in progress
+	transferBox *tview.TextView
+	// Number of rows of the transfer box, only accessed from the event handler
+	transferRows int
+	// Represents the UI element holding the message, transfer and direct message boxes
+	mainColumn *tview.Flex
 	// Represents the UI element for the input field
 	inputBox *tview.InputField
 }
@@ -33,6 +63,51 @@ type UI struct {
 type uicommand struct {
 	cmdtype string
 	cmdarg  string
+	// The room that was active when the command was entered
+	room *ChatRoom
+}
+
+// A structure that represents the UI state of a joined room
+type roomview struct {
+	// Represents the ChatRoom shown
+	room *ChatRoom
+	// Represents the UI element with the room's messages and logs
+	messageBox *tview.TextView
+	// Number of messages received while the room was not shown
+	unread int
+	// Represents the lines shown in the message box
+	lines []viewline
+}
+
+// A structure that represents a line of a room's message box. Lines that
+// show a message keep how they were rendered, so they can be redrawn once
+// the message is edited or deleted.
+type viewline struct {
+	text   string
+	msgID  string
+	render func(msg chatMsg) string
+}
+
+// A structure that represents an event from one of the joined rooms
+type roomevent struct {
+	room    *ChatRoom
+	msg     *chatMsg
+	records []historyRecord
+	log     *logEntry
+}
+
+// A structure that represents a room to show, or to remove once left
+type roomchange struct {
+	room *ChatRoom
+	part bool
+}
+
+// A structure that represents a file offer to accept or decline
+type offerprompt struct {
+	offer  fileOffer
+	sender string
+	// The room the offer was received in
+	room *ChatRoom
 }
 
 // A constructor function that generates and
@@ -45,22 +120,48 @@ func NewUI(cr *ChatRoom) *UI {
 	cmdchan := make(chan uicommand)
 	msgchan := make(chan string)
 
-	// Create a message box
-	messagebox := tview.NewTextView().
+	// Create the pages for the message box of each room
+	messagepages := tview.NewPages()
+
+	// Create a joined room box
+	roombox := tview.NewTextView().
+		SetDynamicColors(true)
+
+	roombox.
+		SetBorder(true).
+		SetBorderColor(tcell.ColorBlue).
+		SetTitle("Rooms").
+		SetTitleAlign(tview.AlignLeft).
+		SetTitleColor(tcell.ColorWhite)
+
+	// Create a direct message box
+	dmbox := tview.NewTextView().
 		SetDynamicColors(true).
 		SetChangedFunc(func() {
 			app.Draw()
 		})
 
-	messagebox.
+	dmbox.
 		SetBorder(true).
-		SetBorderColor(tcell.ColorBlue).
-		SetTitle(cr.RoomName).
+		SetBorderColor(tcell.ColorPurple).
+		SetTitle("Direct Messages").
+		SetTitleAlign(tview.AlignLeft).
+		SetTitleColor(tcell.ColorWhite)
+
+	// Create a transfer box, hidden while no transfer is in progress
+	transferbox := tview.NewTextView().
+		SetDynamicColors(true)
+
+	transferbox.
+		SetBorder(true).
+		SetBorderColor(tcell.ColorGreen).
+		SetTitle("Transfers").
 		SetTitleAlign(tview.AlignLeft).
 		SetTitleColor(tcell.ColorWhite)
 
 	// Create peer ID box
-	peerbox := tview.NewTextView()
+	peerbox := tview.NewTextView().
+		SetDynamicColors(true)
 
 	peerbox.
 		SetBorder(true).
@@ -100,8 +201,8 @@ func NewUI(cr *ChatRoom) *UI {
 
 		// Check for command inputs
 		if strings.HasPrefix(line, "/") {
-			// Split the command
-			cmdparts := strings.Split(line, " ")
+			// Split the command from the rest of the line
+			cmdparts := strings.SplitN(line, " ", 2)
 
 			// Add a nil arg if there is no argument
 			if len(cmdparts) == 1 {
@@ -120,36 +221,87 @@ func NewUI(cr *ChatRoom) *UI {
 		input.SetText("")
 	})
 
+	// Create a flexbox for the messages, transfers and direct messages
+	maincolumn := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(messagepages, 0, 3, false).
+		AddItem(transferbox, 0, 0, false).
+		AddItem(dmbox, 0, 1, false)
+
 	// Create a flexbox to fit all the widgets
 	flex := tview.NewFlex().SetDirection(tview.FlexRow).
 		// AddItem(titlebox, 3, 1, false).
 		AddItem(tview.NewFlex().SetDirection(tview.FlexColumn).
-			AddItem(messagebox, 0, 1, false).
-			AddItem(peerbox, 20, 1, false),
+			AddItem(maincolumn, 0, 1, false).
+			AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+				AddItem(roombox, 0, 1, false).
+				AddItem(peerbox, 0, 2, false),
+				20, 1, false),
 			0, 8, false).
 		AddItem(input, 3, 1, true)
 		// AddItem(usage, 3, 1, false)
 
-	// Set the flex as the app root
-	app.SetRoot(flex, true)
+	// Layer the flex under the prompts and set it as the app root
+	layers := tview.NewPages().
+		AddPage("main", flex, true, true)
+	app.SetRoot(layers, true)
 
-	// Create UI and return it
-	return &UI{
-		ChatRoom:    cr,
-		TerminalApp: app,
-		peerBox:     peerbox,
-		messageBox:  messagebox,
-		inputBox:    input,
-		MsgInputs:   msgchan,
-		CmdInputs:   cmdchan,
+	// Create UI
+	ui := &UI{
+		ChatRoom:     cr,
+		Rooms:        NewRoomManager(cr),
+		TerminalApp:  app,
+		roomBox:      roombox,
+		peerBox:      peerbox,
+		messagePages: messagepages,
+		dmBox:        dmbox,
+		transferBox:  transferbox,
+		mainColumn:   maincolumn,
+		inputBox:     input,
+		layers:       layers,
+		MsgInputs:    msgchan,
+		CmdInputs:    cmdchan,
+		roomChanges:  make(chan roomchange),
+		roomEvents:   make(chan roomevent),
+		done:         make(chan struct{}),
+		views:        make(map[*ChatRoom]*roomview),
 	}
+
+	// Define keyboard shortcuts to switch rooms: Alt+1..9 jumps to a
+	// room, Ctrl+N and Ctrl+P move to the next and previous room
+	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		var target *ChatRoom
+		switch {
+		case event.Key() == tcell.KeyCtrlN:
+			target = ui.Rooms.Next(1)
+		case event.Key() == tcell.KeyCtrlP:
+			target = ui.Rooms.Next(-1)
+		case event.Key() == tcell.KeyRune && event.Modifiers()&tcell.ModAlt != 0 &&
+			event.Rune() >= '1' && event.Rune() <= '9':
+			target = ui.Rooms.At(int(event.Rune() - '1'))
+		default:
+			return event
+		}
+
+		// Switch from the event handler, never block the tview loop
+		if target != nil {
+			go ui.switchroom(target)
+		}
+		return nil
+	})
+
+	// Show the first room with its stored history
+	ui.showroom(cr)
+
+	// Register the username and return the UI
+	go ui.claimname(cr, cr.Username)
+	return ui
 }
 
 // A method of UI that starts the UI app
 func (ui *UI) Run() error {
 	go ui.starteventhandler()
 
-	defer ui.cancelCtx()
+	defer close(ui.done)
 	return ui.TerminalApp.Run()
 }
 
@@ -162,36 +314,128 @@ func (ui *UI) starteventhandler() {
 		select {
 
 		case msg := <-ui.MsgInputs:
-			// Send the message to OutgoingMessages queue
-			ui.OutgoingMessages <- msg
-			// Add the message to the message box as a self message
-			ui.display_selfmessage(msg)
+			// Send the message to OutgoingMessages queue, it is shown
+			// once it comes back from the room, in order. Nothing reads
+			// the queue of a room that was left
+			select {
+			case ui.OutgoingMessages <- msg:
+			case <-ui.roomCtx.Done():
+			case <-ui.done:
+				return
+			}
 
 		case cmd := <-ui.CmdInputs:
-			// Handle the recieved command
+			// Handle the recieved command in the room active now, the
+			// active room is only changed by this event handler
+			cmd.room = ui.ChatRoom
 			go ui.handlecommand(cmd)
 
-		case msg := <-ui.IncomingMessages:
-			// Print the recieved messages to the message box
-			ui.display_chatmessage(msg)
+		case event := <-ui.roomEvents:
+			// Print the event to the message box of its room
+			ui.handleroomevent(event)
+
+		case change := <-ui.roomChanges:
+			// Show a room or remove one that was left
+			if change.part {
+				ui.removeroom(change.room)
+			} else {
+				ui.showroom(change.room)
+			}
 
-		case log := <-ui.LogChannel:
-			// Add the log to the message box
-			ui.display_logmessage(log)
+		case dm := <-ui.NodeHost.DirectMessages:
+			// Add the direct message to the direct message box
+			ui.display_directmessage(dm)
+
+			// Ask whether to accept a file offered by the peer
+			if dm.Offer != nil && !dm.Self {
+				sender := fmt.Sprintf("%s (%s)", dm.SenderName, shortID(dm.PeerID.Pretty()))
+				ui.handleoffer(ui.views[ui.ChatRoom], *dm.Offer, sender)
+			}
 
 		case <-refreshticker.C:
 			// Refresh the list of peers in the chat room periodically
 			ui.syncpeerbox()
+			// Refresh the progress of the file transfers
+			ui.synctransferbox()
 
-		case <-ui.roomCtx.Done():
+		case <-ui.done:
 			// End the event loop
 			return
 		}
 	}
 }
 
+// A method of UI that forwards the events of a joined room to the event handler
+func (ui *UI) watchroom(cr *ChatRoom) {
+	for {
+		var event roomevent
+		select {
+		case msg, ok := <-cr.IncomingMessages:
+			if !ok {
+				return
+			}
+			event = roomevent{room: cr, msg: &msg}
+		case records := <-cr.CatchUpMessages:
+			event = roomevent{room: cr, records: records}
+		case log := <-cr.LogChannel:
+			event = roomevent{room: cr, log: &log}
+		case <-cr.roomCtx.Done():
+			return
+		case <-ui.done:
+			return
+		}
+
+		select {
+		case ui.roomEvents <- event:
+		case <-ui.done:
+			return
+		}
+	}
+}
+
+// A method of UI that displays a room event in the room it belongs to
+func (ui *UI) handleroomevent(event roomevent) {
+	// Ignore late events of a room that was left
+	view, ok := ui.views[event.room]
+	if !ok {
+		return
+	}
+
+	unread := 0
+	switch {
+	case event.msg != nil && isChange(*event.msg):
+		// Redraw the message that was edited or deleted
+		ui.redrawmessages(view)
+	case event.msg != nil:
+		ui.display_chatmessage(view, *event.msg)
+		if !event.msg.Self {
+			unread = 1
+		}
+
+		// Ask whether to accept a file offered to the room
+		if event.msg.Offer != nil {
+			sender := fmt.Sprintf("%s (%s)", event.room.displayName(*event.msg), shortID(event.msg.SenderID))
+			ui.handleoffer(view, *event.msg.Offer, sender)
+		}
+	case event.records != nil:
+		ui.display_history(view, event.records, fmt.Sprintf("%d earlier messages from peers", len(event.records)))
+		unread = len(event.records)
+		// Earlier messages may have been changed by the history
+		ui.redrawmessages(view)
+	case event.log != nil:
+		ui.display_logmessage(view, *event.log)
+	}
+
+	// Count messages of hidden rooms as unread
+	if unread > 0 && event.room != ui.ChatRoom {
+		view.unread += unread
+		ui.syncroombox()
+	}
+}
+
 // A method of UI that handles a UI command
 func (ui *UI) handlecommand(cmd uicommand) {
+	cr := cmd.room
 
 	switch cmd.cmdtype {
 
@@ -204,85 +448,784 @@ func (ui *UI) handlecommand(cmd uicommand) {
 	// Check for the room change command
 	case "/r":
 		if cmd.cmdarg == "" {
-			ui.LogChannel <- logEntry{Prefix: "badcmd", Msg: "missing room name for command"}
+			cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: "missing room name for command"}
 		} else {
-			ui.LogChannel <- logEntry{Prefix: "roomchange", Msg: fmt.Sprintf("joining new room '%s'", cmd.cmdarg)}
-
-			// Create a reference to the current chatroom
-			oldchatroom := ui.ChatRoom
+			cr.LogChannel <- logEntry{Prefix: "roomchange", Msg: fmt.Sprintf("joining new room '%s'", cmd.cmdarg)}
 
 			// Create a new chatroom and join it
-			newchatroom, err := JoinRoom(ui.NodeHost, ui.Username, cmd.cmdarg)
+			newchatroom, err := JoinRoom(cr.NodeHost, cr.Username, cmd.cmdarg)
 			if err != nil {
-				ui.LogChannel <- logEntry{Prefix: "jumperr", Msg: fmt.Sprintf("could not change chat room - %s", err)}
+				cr.LogChannel <- logEntry{Prefix: "jumperr", Msg: fmt.Sprintf("could not change chat room - %s", err)}
 				return
 			}
+			ui.switchroom(newchatroom)
+		}
 
-			// Assign the new chat room to UI
-			ui.ChatRoom = newchatroom
-			// Sleep for a second to give time for the queues to adapt
-			time.Sleep(time.Second * 1)
+	// Check for the private room command
+	case "/private":
+		parts := strings.SplitN(cmd.cmdarg, " ", 2)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: "usage: /private <roomname> <passphrase>"}
+			return
+		}
+		cr.LogChannel <- logEntry{Prefix: "roomchange", Msg: fmt.Sprintf("joining private room '%s'", parts[0])}
 
-			// Exit the old chatroom and pause for two seconds
-			oldchatroom.Leave()
+		// Derive the room key from the shared passphrase
+		key, err := DeriveRoomKey(parts[0], parts[1])
+		if err != nil {
+			cr.LogChannel <- logEntry{Prefix: "jumperr", Msg: fmt.Sprintf("could not derive room key - %s", err)}
+			return
+		}
 
-			// Clear the UI message box
-			ui.messageBox.Clear()
-			// Update the chat room UI element
-			ui.messageBox.SetTitle(fmt.Sprintf("ChatRoom-%s", ui.ChatRoom.RoomName))
+		// Create a new private chatroom and join it
+		newchatroom, err := JoinPrivateRoom(cr.NodeHost, cr.Username, parts[0], key)
+		if err != nil {
+			cr.LogChannel <- logEntry{Prefix: "jumperr", Msg: fmt.Sprintf("could not change chat room - %s", err)}
+			return
+		}
+		ui.switchroom(newchatroom)
+
+	// Check for the invite command
+	case "/invite":
+		token, err := cr.CreateInvite()
+		if err != nil {
+			cr.LogChannel <- logEntry{Prefix: "error", Msg: fmt.Sprintf("could not create invite - %s", err)}
+			return
+		}
+		msg := fmt.Sprintf("share this token, valid for 24 hours: %s", token)
+
+		// Render the token as a QR code for scanning from another screen
+		if code, err := RenderQR(token); err == nil {
+			msg += "\n" + code
+		}
+		cr.LogChannel <- logEntry{Prefix: "invite", Msg: msg}
+
+	// Check for the join command
+	case "/join":
+		if cmd.cmdarg == "" {
+			cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: "missing invite token for command"}
+			return
+		}
+
+		// Verify the invite before connecting anywhere
+		invite, err := ParseInvite(cmd.cmdarg)
+		if err != nil {
+			cr.LogChannel <- logEntry{Prefix: "jumperr", Msg: fmt.Sprintf("invalid invite - %s", err)}
+			return
+		}
+		cr.LogChannel <- logEntry{Prefix: "roomchange", Msg: fmt.Sprintf("joining room '%s' invited by %s", peertext(invite.Room), shortID(invite.Inviter.ID.Pretty()))}
+
+		// Connect to the inviter and join the room
+		newchatroom, err := cr.NodeHost.AcceptInvite(invite, cr.Username)
+		if err != nil {
+			cr.LogChannel <- logEntry{Prefix: "jumperr", Msg: fmt.Sprintf("could not change chat room - %s", err)}
+			return
+		}
+		ui.switchroom(newchatroom)
+
+	// Check for the room leave command
+	case "/part":
+		// Leave the active room unless another one is named
+		target := cr
+		if cmd.cmdarg != "" {
+			if target = ui.Rooms.Find(cmd.cmdarg); target == nil {
+				cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: fmt.Sprintf("not a member of room '%s'", cmd.cmdarg)}
+				return
+			}
+		}
+
+		if err := ui.Rooms.Part(target); err != nil {
+			cr.LogChannel <- logEntry{Prefix: "parterr", Msg: err.Error()}
+			return
+		}
+		select {
+		case ui.roomChanges <- roomchange{room: target, part: true}:
+		case <-ui.done:
 		}
 
 	// Check for the user change command
 	case "/u":
 		if cmd.cmdarg == "" {
-			ui.LogChannel <- logEntry{Prefix: "badcmd", Msg: "missing user name for command"}
+			cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: "missing user name for command"}
 		} else {
-			// Update the chat user name
-			ui.UpdateUsername(cmd.cmdarg)
+			// Update the chat user name in every joined room
+			for _, room := range ui.Rooms.Rooms() {
+				room.UpdateUsername(cmd.cmdarg)
+			}
+			// Register the new name
+			go ui.claimname(cr, cmd.cmdarg)
 			// Update the chat room UI element
-			ui.inputBox.SetLabel(ui.Username + " > ")
+			ui.inputBox.SetLabel(cmd.cmdarg + " > ")
+		}
+
+	// Check for the away and back commands
+	case "/away", "/back":
+		away := cmd.cmdtype == "/away"
+		for _, room := range ui.Rooms.Rooms() {
+			room.SetAway(away)
+		}
+		if away {
+			cr.LogChannel <- logEntry{Prefix: "status", Msg: "you are shown as away"}
+		} else {
+			cr.LogChannel <- logEntry{Prefix: "status", Msg: "you are shown as online"}
 		}
 
+	// Check for the file offer commands
 	case "/send":
 		if cmd.cmdarg == "" {
-			ui.LogChannel <- logEntry{Prefix: "badcmd", Msg: "missing file name for command"}
+			cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: "missing file name for command"}
 		} else {
-			err := ui.ChatRoom.SendFile(cmd.cmdarg)
+			err := cr.SendFile(cmd.cmdarg)
 			if err != nil {
-				ui.LogChannel <- logEntry{Prefix: "error", Msg: fmt.Sprintf("Failed to send file: %s", err)}
+				cr.LogChannel <- logEntry{Prefix: "error", Msg: fmt.Sprintf("Failed to send file: %s", err)}
 			} else {
-				ui.LogChannel <- logEntry{Prefix: "info", Msg: "File sent successfully!"}
+				cr.LogChannel <- logEntry{Prefix: "info", Msg: "File offered to the room"}
 			}
 		}
 
+	case "/sendto":
+		parts := strings.SplitN(cmd.cmdarg, " ", 2)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: "usage: /sendto <peer-or-name> <file>"}
+			return
+		}
+
+		// Find the recipient among the room peers
+		target, err := cr.ResolvePeer(parts[0])
+		if err != nil {
+			cr.LogChannel <- logEntry{Prefix: "error", Msg: err.Error()}
+			return
+		}
+
+		// Offer the file with a direct message
+		if err := cr.NodeHost.SendFileTo(cr.roomCtx, target, cr.Username, parts[1]); err != nil {
+			cr.LogChannel <- logEntry{Prefix: "error", Msg: fmt.Sprintf("Failed to send file: %s", err)}
+			return
+		}
+		cr.LogChannel <- logEntry{Prefix: "info", Msg: fmt.Sprintf("File offered to %s", parts[0])}
+
+	// Check for the content-addressed file sharing commands
+	case "/share":
+		if cmd.cmdarg == "" {
+			cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: "missing file name for command"}
+			return
+		}
+
+		// Store the file as blocks and announce it in the DHT
+		root, manifest, err := cr.NodeHost.ShareFile(cr, cmd.cmdarg)
+		if err != nil {
+			cr.LogChannel <- logEntry{Prefix: "error", Msg: fmt.Sprintf("Failed to share file: %s", err)}
+			return
+		}
+
+		// Post the CID in the room it was shared in, which may no longer
+		// be the active one, so it is kept in the room history
+		text := fmt.Sprintf("shared %s (%s) - /get %s", manifest.Name, formatSize(manifest.Size), root)
+		if err := cr.publishText(text, ""); err != nil {
+			cr.LogChannel <- logEntry{Prefix: "error", Msg: fmt.Sprintf("Failed to post shared file: %s", err)}
+		}
+
+	case "/get":
+		if cmd.cmdarg == "" {
+			cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: "missing CID for command"}
+			return
+		}
+		cr.LogChannel <- logEntry{Prefix: "info", Msg: fmt.Sprintf("fetching %s", cmd.cmdarg)}
+
+		// Fetch the blocks from whichever peers hold them
+		path, err := cr.NodeHost.FetchFile(cr.NodeHost.Context, cr, cmd.cmdarg)
+		if err != nil {
+			cr.LogChannel <- logEntry{Prefix: "error", Msg: fmt.Sprintf("Failed to fetch file: %s", err)}
+			return
+		}
+		cr.LogChannel <- logEntry{Prefix: "info", Msg: fmt.Sprintf("File saved to %s", path)}
+
+	// Check for the file accept and decline commands
+	case "/accept":
+		if cmd.cmdarg == "" {
+			cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: "missing offer ID for command"}
+			return
+		}
+		ui.acceptoffer(cr, cmd.cmdarg)
+
+	case "/decline":
+		if cmd.cmdarg == "" {
+			cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: "missing offer ID for command"}
+			return
+		}
+		ui.declineoffer(cr, cmd.cmdarg)
+
+	// Check for the reply and thread commands
+	case "/reply":
+		parts := strings.SplitN(cmd.cmdarg, " ", 2)
+		if len(parts) < 2 || parts[0] == "" || strings.TrimSpace(parts[1]) == "" {
+			cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: "usage: /reply <message-ref> <text>"}
+			return
+		}
+
+		parent, err := cr.messages.resolve(parts[0])
+		if err != nil {
+			cr.LogChannel <- logEntry{Prefix: "error", Msg: err.Error()}
+			return
+		}
+		if err := cr.Reply(parent.ID, parts[1]); err != nil {
+			cr.LogChannel <- logEntry{Prefix: "error", Msg: fmt.Sprintf("Failed to send reply: %s", err)}
+		}
+
+	case "/thread":
+		if cmd.cmdarg == "" {
+			cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: "missing message reference for command"}
+			return
+		}
+
+		msg, err := cr.messages.resolve(cmd.cmdarg)
+		if err != nil {
+			cr.LogChannel <- logEntry{Prefix: "error", Msg: err.Error()}
+			return
+		}
+
+		// Build the view from the tview loop
+		entries := cr.messages.thread(msg.ID)
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			ui.showthread(cr, entries)
+		})
+
+	// Check for the edit and delete commands
+	case "/edit":
+		parts := strings.SplitN(cmd.cmdarg, " ", 2)
+		if len(parts) < 2 || parts[0] == "" || strings.TrimSpace(parts[1]) == "" {
+			cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: "usage: /edit <message-ref> <text>"}
+			return
+		}
+
+		msg, err := cr.messages.resolve(parts[0])
+		if err != nil {
+			cr.LogChannel <- logEntry{Prefix: "error", Msg: err.Error()}
+			return
+		}
+		if err := cr.Edit(msg.ID, parts[1]); err != nil {
+			cr.LogChannel <- logEntry{Prefix: "error", Msg: fmt.Sprintf("Failed to edit message: %s", err)}
+		}
+
+	case "/delete":
+		if cmd.cmdarg == "" {
+			cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: "missing message reference for command"}
+			return
+		}
+
+		msg, err := cr.messages.resolve(cmd.cmdarg)
+		if err != nil {
+			cr.LogChannel <- logEntry{Prefix: "error", Msg: err.Error()}
+			return
+		}
+		if err := cr.Retract(msg.ID); err != nil {
+			cr.LogChannel <- logEntry{Prefix: "error", Msg: fmt.Sprintf("Failed to delete message: %s", err)}
+		}
+
+	// Check for the reaction command
+	case "/react":
+		parts := strings.SplitN(cmd.cmdarg, " ", 2)
+		if len(parts) < 2 || parts[0] == "" || strings.TrimSpace(parts[1]) == "" {
+			cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: "usage: /react <message-ref> <emoji>"}
+			return
+		}
+
+		msg, err := cr.messages.resolve(parts[0])
+		if err != nil {
+			cr.LogChannel <- logEntry{Prefix: "error", Msg: err.Error()}
+			return
+		}
+		if err := cr.React(msg.ID, parts[1]); err != nil {
+			cr.LogChannel <- logEntry{Prefix: "error", Msg: fmt.Sprintf("Failed to react: %s", err)}
+		}
+
+	// Check for the transfer commands
+	case "/transfers":
+		transfers := cr.NodeHost.Transfers.List()
+		if len(transfers) == 0 {
+			cr.LogChannel <- logEntry{Prefix: "transfers", Msg: "no transfers in progress"}
+		}
+		for _, info := range transfers {
+			cr.LogChannel <- logEntry{Prefix: "transfers", Msg: describetransfer(info)}
+		}
+
+	case "/cancel":
+		if cmd.cmdarg == "" {
+			cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: "missing transfer ID for command"}
+			return
+		}
+		if err := cr.NodeHost.Transfers.Cancel(cmd.cmdarg); err != nil {
+			cr.LogChannel <- logEntry{Prefix: "error", Msg: err.Error()}
+			return
+		}
+		cr.LogChannel <- logEntry{Prefix: "info", Msg: fmt.Sprintf("cancelled transfer %s", cmd.cmdarg)}
+
+	// Check for the direct message command
+	case "/msg":
+		parts := strings.SplitN(cmd.cmdarg, " ", 2)
+		if len(parts) < 2 || parts[0] == "" || strings.TrimSpace(parts[1]) == "" {
+			cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: "usage: /msg <peer-or-name> <text>"}
+			return
+		}
+
+		// Find the recipient among the room peers
+		target, err := cr.ResolvePeer(parts[0])
+		if err != nil {
+			cr.LogChannel <- logEntry{Prefix: "dmerr", Msg: err.Error()}
+			return
+		}
+
+		// Deliver the message and wait for its acknowledgement
+		err = cr.NodeHost.SendDirectMessage(cr.roomCtx, target, cr.Username, parts[1])
+		if err != nil {
+			cr.LogChannel <- logEntry{Prefix: "dmerr", Msg: fmt.Sprintf("could not message %s - %s", parts[0], err)}
+			return
+		}
+		ui.display_directmessage(directMsg{Text: parts[1], SenderName: parts[0], PeerID: target, Self: true})
+
 	// Unsupported command
 	default:
-		ui.LogChannel <- logEntry{Prefix: "badcmd", Msg: fmt.Sprintf("unsupported command - %s", cmd.cmdtype)}
+		cr.LogChannel <- logEntry{Prefix: "badcmd", Msg: fmt.Sprintf("unsupported command - %s", cmd.cmdtype)}
+	}
+}
+
+// A method of UI that downloads an offered file, logging to the given room
+func (ui *UI) acceptoffer(cr *ChatRoom, id string) {
+	cr.LogChannel <- logEntry{Prefix: "info", Msg: fmt.Sprintf("downloading offer %s", id)}
+
+	// Download the file straight from its sender
+	path, err := cr.NodeHost.AcceptFile(cr.NodeHost.Context, id)
+	if err != nil {
+		cr.LogChannel <- logEntry{Prefix: "error", Msg: fmt.Sprintf("Failed to receive file: %s", err)}
+		return
 	}
+	cr.LogChannel <- logEntry{Prefix: "info", Msg: fmt.Sprintf("File saved to %s", path)}
+}
+
+// A method of UI that declines an offered file, logging to the given room
+func (ui *UI) declineoffer(cr *ChatRoom, id string) {
+	if err := cr.NodeHost.DeclineFile(id); err != nil {
+		cr.LogChannel <- logEntry{Prefix: "error", Msg: err.Error()}
+		return
+	}
+	cr.LogChannel <- logEntry{Prefix: "info", Msg: fmt.Sprintf("declined offer %s", id)}
+}
+
+// A method of UI that prompts for an incoming file offer, or ignores it
+// when the file is larger than accepted
+func (ui *UI) handleoffer(view *roomview, offer fileOffer, sender string) {
+	if !ui.NodeHost.AcceptsFileSize(offer.Size) {
+		ui.NodeHost.DeclineFile(offer.ID)
+		if view != nil {
+			ui.display_logmessage(view, logEntry{Prefix: "info", Msg: fmt.Sprintf("ignored %s from %s, larger than %s", peertext(offer.Name), peertext(sender), formatSize(ui.NodeHost.downloads.MaxSize))})
+		}
+		return
+	}
+
+	// Queue the prompt from the tview loop, never block the event handler
+	prompt := offerprompt{offer: offer, sender: sender, room: ui.ChatRoom}
+	if view != nil {
+		prompt.room = view.room
+	}
+	go ui.TerminalApp.QueueUpdateDraw(func() {
+		ui.offerQueue = append(ui.offerQueue, prompt)
+		if len(ui.offerQueue) == 1 {
+			ui.showofferprompt()
+		}
+	})
+}
+
+// A method of UI that shows the first queued file offer in a modal
+// prompt. It must be called from the tview loop.
+func (ui *UI) showofferprompt() {
+	prompt := ui.offerQueue[0]
+	text := fmt.Sprintf("%s offers a file\n\n%s\n%s\n\nAccepted files are saved to %s",
+		tview.Escape(prompt.sender), tview.Escape(prompt.offer.Name), formatSize(prompt.offer.Size), tview.Escape(prompt.room.NodeHost.downloads.Dir))
+
+	modal := tview.NewModal().
+		SetText(text).
+		AddButtons([]string{"Accept", "Decline"}).
+		SetDoneFunc(func(index int, label string) {
+			// Escape closes the prompt and leaves the offer pending
+			switch label {
+			case "Accept":
+				go ui.acceptoffer(prompt.room, prompt.offer.ID)
+			case "Decline":
+				go ui.declineoffer(prompt.room, prompt.offer.ID)
+			}
+
+			// Show the next offer or return to the input box
+			ui.layers.RemovePage("offer")
+			ui.offerQueue = ui.offerQueue[1:]
+			if len(ui.offerQueue) > 0 {
+				ui.showofferprompt()
+			} else {
+				ui.TerminalApp.SetFocus(ui.inputBox)
+			}
+		})
+
+	ui.layers.AddPage("offer", modal, true, true)
+	ui.TerminalApp.SetFocus(modal)
+}
+
+// A method of UI that registers a username in the DHT, warning in the
+// given room when another peer already owns it
+func (ui *UI) claimname(cr *ChatRoom, name string) {
+	err := cr.NodeHost.ClaimName(name)
+	switch {
+	case errors.Is(err, ErrNameTaken):
+		cr.LogChannel <- logEntry{Prefix: "warning", Msg: fmt.Sprintf("'%s' %s, others see you as %s#%s", name, err, name, shortID(cr.NodeHost.Host.ID().Pretty()))}
+	case err != nil:
+		cr.LogChannel <- logEntry{Prefix: "warning", Msg: fmt.Sprintf("could not register name '%s' - %s", name, err)}
+	}
+}
+
+// A method of UI that asks the event handler to show a chat room,
+// keeping the other joined rooms subscribed in the background
+func (ui *UI) switchroom(newchatroom *ChatRoom) {
+	select {
+	case ui.roomChanges <- roomchange{room: newchatroom}:
+	case <-ui.done:
+	}
+}
+
+// A method of UI that shows a chat room, adding a message box for it
+// the first time it is shown
+func (ui *UI) showroom(cr *ChatRoom) {
+	view, ok := ui.views[cr]
+	if !ok {
+		view = ui.addroomview(cr)
+	}
+
+	// Make the room the active one
+	ui.Rooms.Add(cr)
+	ui.Rooms.SetActive(cr)
+	ui.ChatRoom = cr
+	ui.messageBox = view.messageBox
+	view.unread = 0
+
+	// Bring the room's message box to the front
+	ui.messagePages.SwitchToPage(cr.historyKey)
+	ui.syncroombox()
+	ui.syncpeerbox()
+}
+
+// A method of UI that creates the message box of a newly joined room
+// and starts forwarding the room's events
+func (ui *UI) addroomview(cr *ChatRoom) *roomview {
+	messagebox := tview.NewTextView().
+		SetDynamicColors(true).
+		SetChangedFunc(func() {
+			ui.TerminalApp.Draw()
+		})
+
+	messagebox.
+		SetBorder(true).
+		SetBorderColor(tcell.ColorBlue).
+		SetTitle(roomtitle(cr)).
+		SetTitleAlign(tview.AlignLeft).
+		SetTitleColor(tcell.ColorWhite)
+
+	view := &roomview{room: cr, messageBox: messagebox}
+	ui.views[cr] = view
+	ui.messagePages.AddPage(cr.historyKey, messagebox, true, false)
+
+	// Show the stored history of the room
+	ui.display_history(view, cr.Backlog, "end of history")
+
+	go ui.watchroom(cr)
+	return view
+}
+
+// A method of UI that removes the message box of a room that was left
+// and shows the room that became active instead
+func (ui *UI) removeroom(cr *ChatRoom) {
+	if _, ok := ui.views[cr]; !ok {
+		return
+	}
+	delete(ui.views, cr)
+	ui.messagePages.RemovePage(cr.historyKey)
+
+	active := ui.Rooms.Active()
+	ui.showroom(active)
+	ui.display_logmessage(ui.views[active], logEntry{Prefix: "roomchange", Msg: fmt.Sprintf("left room '%s'", cr.RoomName)})
+}
+
+// A function that returns the message box title for a chat room
+func roomtitle(cr *ChatRoom) string {
+	if cr.IsPrivate() {
+		return fmt.Sprintf("ChatRoom-%s (private)", cr.RoomName)
+	}
+	return fmt.Sprintf("ChatRoom-%s", cr.RoomName)
 }
 
 // A method of UI that displays a message recieved from a peer
-func (ui *UI) display_chatmessage(msg chatMsg) {
-	prompt := fmt.Sprintf("[green]<%s>:[-]", msg.SenderName)
-	fmt.Fprintf(ui.messageBox, "%s %s\n", prompt, msg.Text)
+func (ui *UI) display_chatmessage(view *roomview, msg chatMsg) {
+	// Show the message reference used by /reply and /thread
+	stamp := fmt.Sprintf("[gray]%s #%s[-]", messagetime(msg, time.Now(), "15:04"), messageRef(msg.ID))
+	prompt := fmt.Sprintf("%s %s [green]<%s>:[-]", stamp, verifiedmarker(msg.Verified), peertext(view.room.displayName(msg)))
+	if msg.Self {
+		prompt = fmt.Sprintf("%s [blue]<%s>:[-]", stamp, peertext(msg.SenderName))
+	}
+	ui.display_replyquote(view, msg)
+	if msg.Offer != nil {
+		ui.printline(view, fmt.Sprintf("%s %s", prompt, describeoffer(msg.Offer)))
+		return
+	}
+	ui.printmessageline(view, msg, func(msg chatMsg) string {
+		return fmt.Sprintf("%s %s%s", prompt, messagetext(msg), reactionline(msg))
+	})
+}
+
+// A function that marks whether the sender ID of a message was bound to
+// its signature
+func verifiedmarker(verified bool) string {
+	if verified {
+		return "[green]✓[-]"
+	}
+	return "[red]?[-]"
+}
+
+// A method of UI that displays a quoted preview of the message a reply
+// answers, above the reply
+func (ui *UI) display_replyquote(view *roomview, msg chatMsg) {
+	if msg.ReplyTo == "" {
+		return
+	}
+
+	parent, ok := view.room.messages.get(msg.ReplyTo)
+	if !ok {
+		ui.printline(view, fmt.Sprintf("[gray]  ┌ reply to #%s[-]", messageRef(msg.ReplyTo)))
+		return
+	}
+	name := peertext(view.room.displayName(parent))
+	ui.printmessageline(view, parent, func(parent chatMsg) string {
+		return fmt.Sprintf("[gray]  ┌ #%s <%s>: %s[-]", messageRef(parent.ID), name, quotepreview(parent))
+	})
+}
+
+// A function that returns the escaped text shown for a message, marking
+// messages that were edited or deleted by their sender
+func messagetext(msg chatMsg) string {
+	switch {
+	case msg.Retracted:
+		return "[gray::i]message deleted[-::-]"
+	case msg.Edited:
+		return fmt.Sprintf("%s [gray](edited)[-]", peertext(msg.Text))
+	}
+	return peertext(msg.Text)
+}
+
+// A function that makes text chosen by a peer safe to print on a single
+// line. Colour tags are escaped and line breaks flattened, so a peer
+// cannot fake lines of other senders or the verified marker.
+func peertext(text string) string {
+	return tview.Escape(linebreaks.Replace(text))
+}
+
+// A replacer that flattens the line breaks of peer text
+var linebreaks = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ")
+
+// A function that returns the reactions to a message as a compact line
+// below it, or nothing if it has none
+func reactionline(msg chatMsg) string {
+	if len(msg.Reactions) == 0 {
+		return ""
+	}
+
+	counts := make([]string, len(msg.Reactions))
+	for i, r := range msg.Reactions {
+		counts[i] = fmt.Sprintf("%s %d", tview.Escape(r.Emoji), len(r.Senders))
+	}
+	return fmt.Sprintf("\n      [gray]%s[-]", strings.Join(counts, "  "))
+}
+
+// A function that shortens a message to an escaped single line preview
+func quotepreview(msg chatMsg) string {
+	const length = 60
+	if msg.Retracted {
+		return "message deleted"
+	}
+	text := strings.Join(strings.Fields(msg.Text), " ")
+	if runes := []rune(text); len(runes) > length {
+		text = string(runes[:length]) + "…"
+	}
+	return tview.Escape(text)
+}
+
+// A method of UI that shows the reply tree of a message over the main
+// layout until Escape is pressed. It must be called from the tview loop.
+func (ui *UI) showthread(cr *ChatRoom, entries []threadEntry) {
+	threadbox := tview.NewTextView().
+		SetDynamicColors(true)
+
+	threadbox.
+		SetBorder(true).
+		SetBorderColor(tcell.ColorYellow).
+		SetTitle(fmt.Sprintf("Thread of #%s (Esc to close)", messageRef(entries[0].msg.ID))).
+		SetTitleAlign(tview.AlignLeft).
+		SetTitleColor(tcell.ColorWhite)
+
+	for _, entry := range entries {
+		indent := strings.Repeat("  ", entry.depth)
+		if entry.depth > 0 {
+			indent += "└ "
+		}
+		color := "green"
+		if entry.msg.Self {
+			color = "blue"
+		}
+		fmt.Fprintf(threadbox, "%s[gray]%s #%s[-] [%s]<%s>:[-] %s\n", indent, messagetime(entry.msg, time.Now(), "Jan 2 15:04"),
+			messageRef(entry.msg.ID), color, peertext(cr.displayName(entry.msg)), messagetext(entry.msg))
+	}
+
+	threadbox.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEscape {
+			ui.layers.RemovePage("thread")
+			ui.TerminalApp.SetFocus(ui.inputBox)
+		}
+	})
+
+	ui.layers.AddPage("thread", threadbox, true, true)
+	ui.TerminalApp.SetFocus(threadbox)
+}
+
+// A function that describes a file offer and how to accept it
+func describeoffer(offer *fileOffer) string {
+	return fmt.Sprintf("offers [::b]%s[::-] (%s) - [yellow]/accept %s[-] or [yellow]/decline %s[-]", peertext(offer.Name), formatSize(offer.Size), offer.ID, offer.ID)
 }
 
-// A method of UI that displays a message recieved from self
-func (ui *UI) display_selfmessage(msg string) {
-	prompt := fmt.Sprintf("[blue]<%s>:[-]", ui.Username)
-	fmt.Fprintf(ui.messageBox, "%s %s\n", prompt, msg)
+// A function that formats the time a message was sent, or the given
+// time for messages of older clients
+func messagetime(msg chatMsg, received time.Time, layout string) string {
+	if sent := msg.sendTime(); !sent.IsZero() {
+		return sent.Local().Format(layout)
+	}
+	return received.Format(layout)
+}
+
+// A method of UI that displays messages loaded from the room history
+func (ui *UI) display_history(view *roomview, records []historyRecord, footer string) {
+	if len(records) == 0 {
+		return
+	}
+
+	for _, rec := range records {
+		stamp := fmt.Sprintf("[gray]%s #%s[-]", messagetime(rec.Message, rec.Time, "Jan 2 15:04"), messageRef(rec.Message.ID))
+		prompt := fmt.Sprintf("%s %s [green]<%s>:[-]", stamp, verifiedmarker(rec.Verified), peertext(view.room.displayName(rec.Message)))
+		if rec.Self {
+			prompt = fmt.Sprintf("%s [blue]<%s>:[-]", stamp, peertext(view.room.displayName(rec.Message)))
+		}
+		ui.display_replyquote(view, rec.Message)
+		ui.printmessageline(view, rec.Message, func(msg chatMsg) string {
+			return fmt.Sprintf("%s %s%s", prompt, messagetext(msg), reactionline(msg))
+		})
+	}
+	ui.printline(view, fmt.Sprintf("[gray]--- %s ---[-]", footer))
+}
+
+// A method of UI that displays a direct message
+func (ui *UI) display_directmessage(dm directMsg) {
+	var prompt string
+	if dm.Self {
+		prompt = fmt.Sprintf("[blue]<you → %s>:[-]", peertext(dm.SenderName))
+	} else {
+		prompt = fmt.Sprintf("[purple]<%s (%s) → you>:[-]", peertext(dm.SenderName), shortID(dm.PeerID.Pretty()))
+	}
+
+	// Describe received offers from their content, not the sender's text
+	if dm.Offer != nil && !dm.Self {
+		fmt.Fprintf(ui.dmBox, "%s %s\n", prompt, describeoffer(dm.Offer))
+		return
+	}
+	fmt.Fprintf(ui.dmBox, "%s %s\n", prompt, peertext(dm.Text))
 }
 
 // A method of UI that displays a log message
-func (ui *UI) display_logmessage(log logEntry) {
+func (ui *UI) display_logmessage(view *roomview, log logEntry) {
 	prompt := fmt.Sprintf("[yellow]<%s>:[-]", log.Prefix)
-	fmt.Fprintf(ui.messageBox, "%s %s\n", prompt, log.Msg)
+	ui.printline(view, fmt.Sprintf("%s %s", prompt, log.Msg))
+}
+
+// A method of UI that appends a line to the message box of a room
+func (ui *UI) printline(view *roomview, text string) {
+	view.lines = append(view.lines, viewline{text: text})
+	fmt.Fprintln(view.messageBox, text)
+}
+
+// A method of UI that appends a line showing a message to the message
+// box of a room, rendered again whenever the message changes
+func (ui *UI) printmessageline(view *roomview, msg chatMsg, render func(msg chatMsg) string) {
+	// Show the message with the changes and reactions applied so far
+	if current, ok := view.room.messages.get(msg.ID); ok {
+		msg = current
+	}
+	text := render(msg)
+	view.lines = append(view.lines, viewline{text: text, msgID: msg.ID, render: render})
+	fmt.Fprintln(view.messageBox, text)
+}
+
+// A method of UI that redraws the message box of a room if any of the
+// messages it shows was edited or deleted since it was printed
+func (ui *UI) redrawmessages(view *roomview) {
+	changed := false
+	for i, line := range view.lines {
+		if line.render == nil {
+			continue
+		}
+		msg, ok := view.room.messages.get(line.msgID)
+		if !ok {
+			continue
+		}
+		if text := line.render(msg); text != line.text {
+			view.lines[i].text = text
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	var text strings.Builder
+	for _, line := range view.lines {
+		text.WriteString(line.text)
+		text.WriteByte('\n')
+	}
+	view.messageBox.SetText(text.String())
+}
+
+// A method of UI that refreshes the list of joined rooms
+func (ui *UI) syncroombox() {
+	// Clear() is not a threadsafe call
+	// So we acquire the thread lock on it
+	ui.roomBox.Lock()
+	ui.roomBox.Clear()
+	ui.roomBox.Unlock()
+
+	// List the rooms in join order with their shortcut number,
+	// highlighting the active room and counting unread messages
+	for i, cr := range ui.Rooms.Rooms() {
+		label := fmt.Sprintf("%d %s", i+1, tview.Escape(cr.RoomName))
+		if cr.IsPrivate() {
+			label += "*"
+		}
+
+		if cr == ui.ChatRoom {
+			label = fmt.Sprintf("[black:white]%s[-:-]", label)
+		} else if view, ok := ui.views[cr]; ok && view.unread > 0 {
+			label = fmt.Sprintf("%s [yellow](%d)[-]", label, view.unread)
+		}
+		fmt.Fprintln(ui.roomBox, label)
+	}
+
+	// Refresh the UI
+	ui.TerminalApp.Draw()
 }
 
 // A method of UI that refreshes the list of peers
 func (ui *UI) syncpeerbox() {
-	// Retrieve the list of peers from the chatroom
-	peers := ui.GetPeers()
+	// Retrieve the peers with a live heartbeat from the chatroom
+	peers := ui.PresentPeers()
 
 	// Clear() is not a threadsafe call
 	// So we acquire the thread lock on it
@@ -294,14 +1237,94 @@ func (ui *UI) syncpeerbox() {
 
 	// Iterate over the list of peers
 	for _, p := range peers {
-		// Generate the pretty version of the peer ID
-		peerid := p.Pretty()
-		// Shorten the peer ID
-		peerid = peerid[len(peerid)-8:]
-		// Add the peer ID to the peer box
-		fmt.Fprintln(ui.peerBox, peerid)
+		// Color the peer by its presence state
+		color, state := "green", ""
+		switch p.Status {
+		case StatusIdle:
+			color, state = "yellow", " idle"
+		case StatusAway:
+			color, state = "gray", " away"
+		}
+
+		// Add the name, short peer ID and state to the peer box
+		fmt.Fprintf(ui.peerBox, "[%s]●[-] %s\n", color, tview.Escape(p.Name))
+		fmt.Fprintf(ui.peerBox, "  [gray]%s%s[-]\n", shortID(p.ID.Pretty()), state)
 	}
 
 	// Refresh the UI
 	ui.TerminalApp.Draw()
+}
+
+// A method of UI that refreshes the progress of the file transfers,
+// showing the transfer box only while transfers are in progress
+func (ui *UI) synctransferbox() {
+	transfers := ui.NodeHost.Transfers.List()
+
+	// Clear() is not a threadsafe call
+	// So we acquire the thread lock on it
+	ui.transferBox.Lock()
+	ui.transferBox.Clear()
+	ui.transferBox.Unlock()
+
+	for _, info := range transfers {
+		fmt.Fprintf(ui.transferBox, "%s %s\n", progressbar(info), describetransfer(info))
+	}
+
+	// Resize the box to fit the transfers, from the tview loop
+	rows := 0
+	if len(transfers) > 0 {
+		rows = minInt(len(transfers), maxTransferRows) + 2
+	}
+	if rows != ui.transferRows {
+		ui.transferRows = rows
+		go ui.TerminalApp.QueueUpdateDraw(func() {
+			ui.mainColumn.ResizeItem(ui.transferBox, rows, 0)
+		})
+	}
+}
+
+// Most transfers shown at once in the transfer box
+const maxTransferRows = 5
+
+// A function that draws the progress bar of a transfer
+func progressbar(info TransferInfo) string {
+	const width = 20
+	if info.Size <= 0 {
+		return "[gray]" + strings.Repeat("░", width) + "[-]"
+	}
+
+	filled := int(minSize(info.Done, info.Size) * width / info.Size)
+	return "[green]" + strings.Repeat("█", filled) + "[gray]" + strings.Repeat("░", width-filled) + "[-]"
+}
+
+// A function that describes the progress of a transfer
+func describetransfer(info TransferInfo) string {
+	arrow, peername := "↓", "peers"
+	if info.Direction == TransferUpload {
+		arrow = "↑"
+	}
+	if info.Peer != "" {
+		peername = shortID(info.Peer.Pretty())
+	}
+
+	progress := formatSize(info.Done)
+	if info.Size > 0 {
+		progress = fmt.Sprintf("%d%% %s/%s", minSize(info.Done, info.Size)*100/info.Size, formatSize(info.Done), formatSize(info.Size))
+	}
+
+	eta := "-"
+	if info.ETA > 0 {
+		eta = info.ETA.Round(time.Second).String()
+	}
+
+	return fmt.Sprintf("[yellow]#%s[-] %s %s %s %s, %s/s, ETA %s",
+		info.ID, arrow, tview.Escape(info.Name), peername, progress, formatSize(int64(info.Rate)), eta)
+}
+
+// A function that returns the smaller of two integers
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
 }
\ No newline at end of file
@@ -0,0 +1,416 @@
+package src
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+// Room messages are encoded as a versioned protobuf envelope:
+//
+//	message Envelope {
+//	  uint32 version = 1;      // wire version of the sender
+//	  uint32 min_version = 2;  // oldest wire version able to read the message
+//	  Kind kind = 3;
+//	  string sender_id = 4;
+//	  string sender_name = 5;
+//	  string text = 6;
+//	  FileOffer offer = 7;
+//	  string status = 8;
+//	  string client = 9;
+//	  string id = 10;
+//	  uint64 time = 11;        // sender wall clock in Unix milliseconds
+//	  uint64 clock = 12;       // sender Lamport clock of the room
+//	  string reply_to = 13;    // ID of the message a text message answers
+//	  string target = 14;      // ID of the message an edit, retraction or reaction is for
+//	}
+//
+//	enum Kind { UNKNOWN = 0; TEXT = 1; OFFER = 2; PRESENCE = 3; reserved 4; EDIT = 5; RETRACT = 6; REACT = 7; }
+//
+//	message FileOffer {
+//	  string id = 1;
+//	  string name = 2;
+//	  uint64 size = 3;
+//	  string hash = 4;
+//	}
+//
+// There is no kind for file chunks. A file offer only announces a file,
+// whose content travels on the fileProtocol and blockProtocol streams.
+//
+// Version 1 is the original JSON encoding, recognised by its leading '{'.
+// It is still read, and still sent until every peer of a room has shown
+// that it reads the envelope, either by sending a newer wire version or
+// by supporting wireProtocol, which covers peers that never publish such
+// as bootstrap relays. Unknown fields are skipped and unknown kinds are
+// ignored, so fields and kinds can be added without a new version. A new version is only
+// needed when older clients would misread a message, and such messages
+// set min_version so older clients drop them instead.
+
+// Wire versions of room messages
+const (
+	wireVersionJSON = 1
+	// WireVersion is the version of the binary envelope sent by this client
+	WireVersion = 2
+)
+
+// Stream protocol announcing that a node reads the binary envelope. Peers
+// learn the protocols of a node when they connect to it.
+const wireProtocol = "/peerchat/wire/2"
+
+// Message kinds of the binary envelope. Kind 4 is reserved, it was never
+// sent.
+const (
+	kindUnknown  = 0
+	kindText     = 1
+	kindOffer    = 2
+	kindPresence = 3
+	kindEdit     = 5
+	kindRetract  = 6
+	kindReact    = 7
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// errNewerProtocol is returned for messages only newer clients can read.
+var errNewerProtocol = errors.New("message requires a newer protocol version")
+
+// errUnreadablePayload is returned for private room payloads that do not
+// decrypt with the room key.
+var errUnreadablePayload = errors.New("payload does not decrypt with the room key")
+
+// encodeMessage serializes a message for the room, as a binary envelope
+// once every room peer reads it or as JSON otherwise, and seals it for a
+// private room.
+func (c *ChatRoom) encodeMessage(msg chatMsg) ([]byte, error) {
+	var data []byte
+	if c.hasLegacyPeers() {
+		// JSON readers ignore the wire field, newer ones learn that we
+		// also read the binary envelope
+		msg.Wire = WireVersion
+		var err error
+		if data, err = json.Marshal(msg); err != nil {
+			return nil, err
+		}
+	} else {
+		data = marshalEnvelope(msg)
+	}
+	return c.sealPayload(data)
+}
+
+// decodeMessage opens a room payload and decodes it from either encoding.
+func (c *ChatRoom) decodeMessage(data []byte) (chatMsg, error) {
+	payload, err := c.openPayload(data)
+	if err != nil {
+		return chatMsg{}, errUnreadablePayload
+	}
+
+	if len(payload) > 0 && payload[0] == '{' {
+		var msg chatMsg
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return chatMsg{}, err
+		}
+		if msg.Wire == 0 {
+			msg.Wire = wireVersionJSON
+		}
+		return msg, nil
+	}
+	return unmarshalEnvelope(payload)
+}
+
+// notePeerWire records the wire version of the last message of a peer.
+// A JSON message without a wire version comes from a JSON-only peer.
+func (c *ChatRoom) notePeerWire(from peer.ID, msg chatMsg) {
+	if from == c.hostID {
+		return
+	}
+
+	c.wireMutex.Lock()
+	defer c.wireMutex.Unlock()
+	c.peerWires[from] = msg.Wire
+}
+
+// hasLegacyPeers reports whether a room peer may only read JSON. Peers
+// that neither sent a newer wire version nor support wireProtocol count
+// as JSON-only.
+func (c *ChatRoom) hasLegacyPeers() bool {
+	peers := c.topic.ListPeers()
+
+	c.wireMutex.Lock()
+	defer c.wireMutex.Unlock()
+	return legacyAmong(peers, c.peerWires, c.NodeHost.readsEnvelope)
+}
+
+// legacyAmong reports whether any of the peers has not shown that it
+// reads the envelope. Versions of peers that left are forgotten.
+func legacyAmong(peers []peer.ID, wires map[peer.ID]int, readsEnvelope func(peer.ID) bool) bool {
+	subscribed := make(map[peer.ID]bool, len(peers))
+	legacy := false
+	for _, p := range peers {
+		subscribed[p] = true
+		if wires[p] < WireVersion && !readsEnvelope(p) {
+			legacy = true
+		}
+	}
+
+	for p := range wires {
+		if !subscribed[p] {
+			delete(wires, p)
+		}
+	}
+	return legacy
+}
+
+// readsEnvelope reports whether a peer announced wireProtocol when it
+// connected.
+func (n *Node) readsEnvelope(p peer.ID) bool {
+	protocols, err := n.Host.Peerstore().SupportsProtocols(p, wireProtocol)
+	return err == nil && len(protocols) > 0
+}
+
+// handleWireRequest answers with the newest wire version this node reads.
+func (n *Node) handleWireRequest(s network.Stream) {
+	defer s.Close()
+	s.Write(appendUvarint(nil, WireVersion))
+}
+
+// warnNewerProtocol asks the user once per peer to upgrade when the peer
+// sends messages this client cannot read.
+func (c *ChatRoom) warnNewerProtocol(from peer.ID) {
+	c.wireMutex.Lock()
+	warned := c.newerPeers[from]
+	c.newerPeers[from] = true
+	c.wireMutex.Unlock()
+
+	if !warned {
+		logrus.Warnf("Peer %s uses a newer protocol version", from)
+		c.LogChannel <- logEntry{Prefix: "warning", Msg: fmt.Sprintf("%s uses a newer version of peerchat, upgrade to see all of its messages", shortID(from.Pretty()))}
+	}
+}
+
+// marshalEnvelope encodes a message as a binary envelope.
+func marshalEnvelope(msg chatMsg) []byte {
+	var b []byte
+	b = appendVarintField(b, 1, WireVersion)
+	b = appendVarintField(b, 2, wireVersionJSON)
+	b = appendVarintField(b, 3, uint64(messageKind(msg.MsgType)))
+	b = appendStringField(b, 4, msg.SenderID)
+	b = appendStringField(b, 5, msg.SenderName)
+	b = appendStringField(b, 6, msg.Text)
+	if msg.Offer != nil {
+		var offer []byte
+		offer = appendStringField(offer, 1, msg.Offer.ID)
+		offer = appendStringField(offer, 2, msg.Offer.Name)
+		offer = appendVarintField(offer, 3, uint64(msg.Offer.Size))
+		offer = appendStringField(offer, 4, msg.Offer.Hash)
+		b = appendBytesField(b, 7, offer)
+	}
+	b = appendStringField(b, 8, msg.Status)
+	b = appendStringField(b, 9, msg.Version)
+	b = appendStringField(b, 10, msg.ID)
+	b = appendVarintField(b, 11, uint64(msg.Time))
+	b = appendVarintField(b, 12, msg.Clock)
+	b = appendStringField(b, 13, msg.ReplyTo)
+	b = appendStringField(b, 14, msg.Target)
+	return b
+}
+
+// unmarshalEnvelope decodes a binary envelope, skipping unknown fields.
+func unmarshalEnvelope(data []byte) (chatMsg, error) {
+	var msg chatMsg
+	var minVersion uint64
+	kind := uint64(kindUnknown)
+
+	err := readFields(data, func(field int, varint uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			msg.Wire = int(varint)
+		case 2:
+			minVersion = varint
+		case 3:
+			kind = varint
+		case 4:
+			msg.SenderID = string(bytes)
+		case 5:
+			msg.SenderName = string(bytes)
+		case 6:
+			msg.Text = string(bytes)
+		case 7:
+			offer, err := unmarshalOffer(bytes)
+			if err != nil {
+				return err
+			}
+			msg.Offer = &offer
+		case 8:
+			msg.Status = string(bytes)
+		case 9:
+			msg.Version = string(bytes)
+		case 10:
+			msg.ID = string(bytes)
+		case 11:
+			msg.Time = int64(varint)
+		case 12:
+			msg.Clock = varint
+		case 13:
+			msg.ReplyTo = string(bytes)
+		case 14:
+			msg.Target = string(bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return chatMsg{}, fmt.Errorf("malformed envelope: %w", err)
+	}
+
+	if minVersion > WireVersion {
+		return chatMsg{}, errNewerProtocol
+	}
+	msg.MsgType = messageType(kind)
+	return msg, nil
+}
+
+// unmarshalOffer decodes the file offer of an envelope.
+func unmarshalOffer(data []byte) (fileOffer, error) {
+	var offer fileOffer
+	err := readFields(data, func(field int, varint uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			offer.ID = string(bytes)
+		case 2:
+			offer.Name = string(bytes)
+		case 3:
+			offer.Size = int64(varint)
+		case 4:
+			offer.Hash = string(bytes)
+		}
+		return nil
+	})
+	return offer, err
+}
+
+// messageKind returns the envelope kind of a message type.
+func messageKind(msgType string) int {
+	switch msgType {
+	case "", "text":
+		return kindText
+	case "offer":
+		return kindOffer
+	case "presence":
+		return kindPresence
+	case "edit":
+		return kindEdit
+	case "retract":
+		return kindRetract
+	case "react":
+		return kindReact
+	}
+	return kindUnknown
+}
+
+// messageType returns the message type of an envelope kind. Kinds added
+// by newer clients get a type that is ignored on receipt.
+func messageType(kind uint64) string {
+	switch kind {
+	case kindText:
+		return "text"
+	case kindOffer:
+		return "offer"
+	case kindPresence:
+		return "presence"
+	case kindEdit:
+		return "edit"
+	case kindRetract:
+		return "retract"
+	case kindReact:
+		return "react"
+	}
+	return fmt.Sprintf("kind-%d", kind)
+}
+
+// appendVarintField appends a varint field, omitting zero values.
+func appendVarintField(b []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = appendUvarint(b, uint64(field)<<3|wireVarint)
+	return appendUvarint(b, value)
+}
+
+// appendBytesField appends a length-delimited field, omitting empty values.
+func appendBytesField(b []byte, field int, value []byte) []byte {
+	if len(value) == 0 {
+		return b
+	}
+	b = appendUvarint(b, uint64(field)<<3|wireBytes)
+	b = appendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// appendStringField appends a string field, omitting empty values.
+func appendStringField(b []byte, field int, value string) []byte {
+	return appendBytesField(b, field, []byte(value))
+}
+
+// appendUvarint appends a value in protobuf varint encoding.
+func appendUvarint(b []byte, value uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], value)]...)
+}
+
+// readFields calls fn for every field of an encoded message with its
+// varint or length-delimited value. Fixed-size fields are skipped.
+func readFields(data []byte, fn func(field int, varint uint64, bytes []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid field tag")
+		}
+		data = data[n:]
+		field := int(tag >> 3)
+
+		switch tag & 7 {
+		case wireVarint:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("invalid varint")
+			}
+			data = data[n:]
+			if err := fn(field, value, nil); err != nil {
+				return err
+			}
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return errors.New("invalid length")
+			}
+			value := data[n : n+int(length)]
+			data = data[n+int(length):]
+			if err := fn(field, 0, value); err != nil {
+				return err
+			}
+		case wireFixed64:
+			if len(data) < 8 {
+				return errors.New("truncated field")
+			}
+			data = data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errors.New("truncated field")
+			}
+			data = data[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", tag&7)
+		}
+	}
+	return nil
+}
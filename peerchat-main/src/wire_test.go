@@ -0,0 +1,196 @@
+package src
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	msgs := []chatMsg{
+		{
+			ID:         "a1b2",
+			Time:       1625000000000,
+			Clock:      42,
+			ReplyTo:    "c3d4",
+			Text:       "hello\nworld",
+			SenderID:   "QmSender",
+			SenderName: "alice",
+			MsgType:    "text",
+		},
+		{
+			ID:         "e5f6",
+			SenderID:   "QmSender",
+			SenderName: "alice",
+			MsgType:    "offer",
+			Offer:      &fileOffer{ID: "f1", Name: "notes.txt", Size: 1 << 20, Hash: "abcd"},
+		},
+		{SenderID: "QmSender", MsgType: "presence", Status: StatusIdle, Version: ClientVersion},
+		{SenderID: "QmSender", MsgType: "edit", Target: "a1b2", Text: "hi"},
+		{SenderID: "QmSender", MsgType: "retract", Target: "a1b2"},
+		{SenderID: "QmSender", MsgType: "react", Target: "a1b2", Text: "👍"},
+	}
+
+	for _, msg := range msgs {
+		got, err := unmarshalEnvelope(marshalEnvelope(msg))
+		if err != nil {
+			t.Fatalf("unmarshalEnvelope(%s): %v", msg.MsgType, err)
+		}
+
+		want := msg
+		want.Wire = WireVersion
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("round trip of %s message:\n got %+v\nwant %+v", msg.MsgType, got, want)
+		}
+	}
+}
+
+func TestEnvelopeUntypedText(t *testing.T) {
+	got, err := unmarshalEnvelope(marshalEnvelope(chatMsg{Text: "hi"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.MsgType != "text" {
+		t.Errorf("message without type decoded as %q, want text", got.MsgType)
+	}
+}
+
+func TestEnvelopeUnknownFields(t *testing.T) {
+	msg := chatMsg{ID: "a1b2", Text: "hello", SenderID: "QmSender", MsgType: "text"}
+	data := marshalEnvelope(msg)
+	data = appendVarintField(data, 99, 7)
+	data = appendStringField(data, 100, "from the future")
+	data = appendUvarint(data, 101<<3|wireFixed64)
+	data = append(data, 1, 2, 3, 4, 5, 6, 7, 8)
+	data = appendUvarint(data, 102<<3|wireFixed32)
+	data = append(data, 1, 2, 3, 4)
+
+	got, err := unmarshalEnvelope(data)
+	if err != nil {
+		t.Fatalf("unknown fields were not skipped: %v", err)
+	}
+	want := msg
+	want.Wire = WireVersion
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestEnvelopeUnknownKind(t *testing.T) {
+	var data []byte
+	data = appendVarintField(data, 1, WireVersion)
+	data = appendVarintField(data, 3, 42)
+	data = appendStringField(data, 6, "hello")
+
+	got, err := unmarshalEnvelope(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.MsgType != "kind-42" {
+		t.Errorf("unknown kind decoded as %q, want kind-42", got.MsgType)
+	}
+}
+
+func TestEnvelopeMinVersion(t *testing.T) {
+	for _, tc := range []struct {
+		minVersion uint64
+		err        error
+	}{
+		{wireVersionJSON, nil},
+		{WireVersion, nil},
+		{WireVersion + 1, errNewerProtocol},
+	} {
+		var data []byte
+		data = appendVarintField(data, 1, tc.minVersion)
+		data = appendVarintField(data, 2, tc.minVersion)
+		data = appendVarintField(data, 3, kindText)
+		data = appendStringField(data, 6, "hello")
+
+		_, err := unmarshalEnvelope(data)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("min_version %d: got error %v, want %v", tc.minVersion, err, tc.err)
+		}
+	}
+}
+
+func TestReadFieldsTruncated(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"tag":            {0x80},
+		"varint":         {1<<3 | wireVarint, 0x80},
+		"length":         {6<<3 | wireBytes, 0x80},
+		"bytes":          {6<<3 | wireBytes, 5, 'h', 'i'},
+		"fixed64":        {11<<3 | wireFixed64, 1, 2, 3},
+		"fixed32":        {11<<3 | wireFixed32, 1},
+		"wire type":      {1<<3 | 3},
+		"nested offer":   {7<<3 | wireBytes, 2, 1<<3 | wireBytes, 9},
+		"huge length":    {6<<3 | wireBytes, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"overlong tag":   {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"missing length": {6<<3 | wireBytes},
+	} {
+		if _, err := unmarshalEnvelope(data); err == nil {
+			t.Errorf("%s: truncated envelope decoded without error", name)
+		}
+	}
+}
+
+func TestUnmarshalEnvelopePrefixes(t *testing.T) {
+	data := marshalEnvelope(chatMsg{
+		ID:         "a1b2",
+		Time:       1625000000000,
+		Clock:      42,
+		Text:       "hello",
+		SenderID:   "QmSender",
+		SenderName: "alice",
+		MsgType:    "offer",
+		Offer:      &fileOffer{ID: "f1", Name: "notes.txt", Size: 1 << 20, Hash: "abcd"},
+	})
+
+	// Every prefix either decodes to fewer fields or fails, without panicking
+	for i := range data {
+		unmarshalEnvelope(data[:i])
+	}
+}
+
+// readsNone is a peerstore lookup for peers that announced no protocols.
+func readsNone(peer.ID) bool {
+	return false
+}
+
+// readsRelay is a peerstore lookup where only the relay announced
+// wireProtocol.
+func readsRelay(p peer.ID) bool {
+	return p == "relay"
+}
+
+func TestLegacyAmong(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		peers  []peer.ID
+		wires  map[peer.ID]int
+		reads  func(peer.ID) bool
+		legacy bool
+	}{
+		{"no peers", nil, map[peer.ID]int{}, readsNone, false},
+		{"all announced", []peer.ID{"a", "b"}, map[peer.ID]int{"a": WireVersion, "b": WireVersion}, readsNone, false},
+		{"json only", []peer.ID{"a", "b"}, map[peer.ID]int{"a": WireVersion, "b": wireVersionJSON}, readsNone, true},
+		{"never heard", []peer.ID{"a", "b"}, map[peer.ID]int{"a": WireVersion}, readsNone, true},
+		{"json peer left", []peer.ID{"a"}, map[peer.ID]int{"a": WireVersion, "b": wireVersionJSON}, readsNone, false},
+		{"silent relay", []peer.ID{"a", "relay"}, map[peer.ID]int{"a": WireVersion}, readsRelay, false},
+		{"silent relay and json peer", []peer.ID{"a", "b", "relay"}, map[peer.ID]int{"a": WireVersion, "b": wireVersionJSON}, readsRelay, true},
+		{"silent relay and silent peer", []peer.ID{"a", "b", "relay"}, map[peer.ID]int{"a": WireVersion}, readsRelay, true},
+	} {
+		if got := legacyAmong(tc.peers, tc.wires, tc.reads); got != tc.legacy {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.legacy)
+		}
+	}
+}
+
+func TestLegacyAmongForgetsPeersThatLeft(t *testing.T) {
+	wires := map[peer.ID]int{"a": WireVersion, "b": wireVersionJSON}
+	legacyAmong([]peer.ID{"a"}, wires, readsNone)
+	if _, ok := wires["b"]; ok {
+		t.Error("wire version of a peer that left was kept")
+	}
+}